@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/arjantop/imageoptimizer/optimizer"
+)
+
+// debugReport describes the optimization of an image. It is served instead of
+// the image when debug reports are enabled and requested.
+type debugReport struct {
+	Source         debugSource       `json:"source"`
+	Chosen         *debugImage       `json:"chosen,omitempty"`
+	Failures       []debugFailure    `json:"failures,omitempty"`
+	BudgetExceeded bool              `json:"budgetExceeded,omitempty"`
+	Probes         []optimizer.Probe `json:"probes,omitempty"`
+	Error          string            `json:"error,omitempty"`
+	ErrorKind      string            `json:"errorKind,omitempty"`
+}
+
+type debugSource struct {
+	MimeType string `json:"mimeType"`
+	Size     int    `json:"size"`
+	// Estimated quality of jpeg sources.
+	JpegQuality int `json:"jpegQuality,omitempty"`
+}
+
+type debugImage struct {
+	Optimizer optimizer.Name    `json:"optimizer"`
+	MimeType  string            `json:"mimeType"`
+	Size      int64             `json:"size"`
+	Probes    []optimizer.Probe `json:"probes,omitempty"`
+}
+
+type debugFailure struct {
+	Optimizer string `json:"optimizer"`
+	Kind      string `json:"kind"`
+	Error     string `json:"error"`
+}
+
+// parseDebug reports whether the debug query parameter is set and removes it
+// from the query forwarded to the origin.
+func parseDebug(requestUrl *url.URL) bool {
+	query := requestUrl.Query()
+	if _, ok := query["debug"]; !ok {
+		return false
+	}
+	query.Del("debug")
+	requestUrl.RawQuery = query.Encode()
+	return true
+}
+
+func newDebugReport(contentType string, source []byte, result *optimizer.Result, err error) *debugReport {
+	report := &debugReport{
+		Source: debugSource{
+			MimeType: contentType,
+			Size:     len(source),
+		},
+	}
+	if contentType == "image/jpeg" {
+		if quality, err := optimizer.EstimateJpegQuality(bytes.NewReader(source)); err == nil {
+			report.Source.JpegQuality = quality
+		}
+	}
+	if err != nil {
+		report.Error = err.Error()
+		report.ErrorKind = optimizer.ErrorKind(err)
+		return report
+	}
+
+	report.Chosen = &debugImage{
+		Optimizer: result.Image.Optimizer,
+		MimeType:  result.Image.MimeType,
+		Size:      result.Image.Size,
+		Probes:    result.Image.Probes,
+	}
+	for _, failure := range result.Failures {
+		report.Failures = append(report.Failures, debugFailure{
+			Optimizer: failure.Optimizer,
+			Kind:      optimizer.ErrorKind(failure),
+			Error:     failure.Err.Error(),
+		})
+	}
+	report.BudgetExceeded = result.BudgetExceeded
+	report.Probes = result.Probes
+	return report
+}
+
+func writeDebugReport(w http.ResponseWriter, report *debugReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Printf("Could not encode debug report err=%s", err)
+	}
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
+	"path"
+	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/arjantop/imageoptimizer/optimizer"
 )
@@ -26,20 +33,271 @@ func reportError(w http.ResponseWriter, msg string, err error) {
 	log.Printf("%s err=%s", msg, err)
 }
 
-func parseAcceptedTypes(acceptHeader string) []string {
+// copyResponse sends the upstream response to the client. When the body has
+// already been decoded the headers describing its encoding are dropped.
+func copyResponse(w http.ResponseWriter, resp *http.Response, body io.Reader, decoded bool) {
+	for key, vals := range resp.Header {
+		if decoded && (key == "Content-Encoding" || key == "Content-Length") {
+			continue
+		}
+		for _, val := range vals {
+			w.Header().Add(key, val)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err := io.Copy(w, body)
+	if err != nil {
+		log.Printf("Could not copy data to client err=%s", err)
+	}
+}
+
+func handleRejectedInput(w http.ResponseWriter, resp *http.Response, body io.Reader, decoded bool, err error) {
+	log.Printf("Source rejected: %s (policy=%s)", err, *inputPolicy)
+	if *inputPolicy == "reject" {
+		http.Error(w, "Source image exceeds limits", http.StatusBadGateway)
+		return
+	}
+	copyResponse(w, resp, body, decoded)
+}
+
+func handleOverload(w http.ResponseWriter, resp *http.Response, body io.Reader, decoded bool) {
+	log.Printf("Optimization queue full (policy=%s)", *overloadPolicy)
+	if *overloadPolicy == "reject" {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Too many images are being optimized", http.StatusServiceUnavailable)
+		return
+	}
+	copyResponse(w, resp, body, decoded)
+}
+
+// handleOptimizeError serves the response for a failed optimization. When the
+// failure is caused by the source image or the tools the original image is
+// served instead.
+func handleOptimizeError(w http.ResponseWriter, resp *http.Response, source []byte, err error) {
+	switch kind := optimizer.ErrorKind(err); kind {
+	case "input_rejected":
+		handleRejectedInput(w, resp, bytes.NewReader(source), true, err)
+	case "queue_full":
+		handleOverload(w, resp, bytes.NewReader(source), true)
+	case "unsupported_input", "decode", "tool_missing", "tool_failure", "timeout":
+		log.Printf("Serving original image kind=%s err=%s", kind, err)
+		copyResponse(w, resp, bytes.NewReader(source), true)
+	default:
+		reportError(w, "Could not optimize the file", err)
+	}
+}
+
+// splitOptimizerSpecs splits settings of the optimizers in the form
+// "name=setting;name=setting".
+func splitOptimizerSpecs(spec string, setting string) (map[string]string, error) {
+	specs := make(map[string]string)
+	for _, optimizerSpec := range strings.Split(spec, ";") {
+		optimizerSpec = strings.TrimSpace(optimizerSpec)
+		if optimizerSpec == "" {
+			continue
+		}
+		parts := strings.SplitN(optimizerSpec, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid " + setting + ": " + optimizerSpec)
+		}
+		specs[parts[0]] = parts[1]
+	}
+	return specs, nil
+}
+
+// parseSearchStrategies parses the strategies of the optimizers in the form
+// "name=strategy;name=strategy".
+func parseSearchStrategies(spec string) (map[string]optimizer.SearchStrategy, error) {
+	specs, err := splitOptimizerSpecs(spec, "search strategy")
+	if err != nil {
+		return nil, err
+	}
+	strategies := make(map[string]optimizer.SearchStrategy)
+	for name, strategySpec := range specs {
+		strategy, err := optimizer.ParseSearchStrategy(strategySpec)
+		if err != nil {
+			return nil, errors.New("invalid search strategy for " + name + ": " + err.Error())
+		}
+		strategies[name] = strategy
+	}
+	return strategies, nil
+}
+
+// parseMetrics parses the metrics of the optimizers in the form
+// "name=metric;name=metric".
+func parseMetrics(spec string) (map[string]optimizer.Metric, error) {
+	specs, err := splitOptimizerSpecs(spec, "metric")
+	if err != nil {
+		return nil, err
+	}
+	metrics := make(map[string]optimizer.Metric)
+	for name, metricSpec := range specs {
+		metric, err := optimizer.ParseMetric(metricSpec)
+		if err != nil {
+			return nil, errors.New("invalid metric for " + name + ": " + err.Error())
+		}
+		metrics[name] = metric
+	}
+	return metrics, nil
+}
+
+// parseByteBudget reads the byte budget from the budget and minScore query
+// parameters and removes them from the query forwarded to the origin. The
+// minSsim parameter is accepted in place of minScore.
+func parseByteBudget(requestUrl *url.URL) (optimizer.ByteBudget, error) {
+	var budget optimizer.ByteBudget
+	query := requestUrl.Query()
+	if _, ok := query["budget"]; !ok {
+		return budget, nil
+	}
+
+	bytes, err := strconv.ParseInt(query.Get("budget"), 10, 64)
+	if err != nil || bytes <= 0 {
+		return budget, errors.New("invalid budget")
+	}
+	budget.Bytes = bytes
+	value := query.Get("minScore")
+	if value == "" {
+		value = query.Get("minSsim")
+	}
+	if value != "" {
+		budget.MinScore, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return budget, errors.New("invalid minScore")
+		}
+	}
+
+	query.Del("budget")
+	query.Del("minScore")
+	query.Del("minSsim")
+	requestUrl.RawQuery = query.Encode()
+	return budget, nil
+}
+
+// reportBudget tells the client whether the image it gets fits into the byte
+// budget it asked for.
+func reportBudget(w http.ResponseWriter, budget optimizer.ByteBudget, size int64) {
+	if budget.Bytes <= 0 {
+		return
+	}
+	if size <= budget.Bytes {
+		w.Header().Set("X-Byte-Budget", "met")
+	} else {
+		w.Header().Set("X-Byte-Budget", "exceeded")
+	}
+}
+
+// Client hint headers the device pixel ratio is read from.
+var dprHeaders = []string{"Sec-CH-DPR", "DPR"}
+
+// maxDpr limits the device pixel ratios taken from requests.
+const maxDpr = 4
+
+// requestDpr returns the device pixel ratio the image is displayed at, from
+// the @1.5x, @2x or @3x suffix of the filename or else from the DPR client
+// hint. The returned flag reports whether the ratio depends on the client hint
+// headers.
+func requestDpr(r *http.Request, requestPath string) (float64, bool) {
+	name := path.Base(requestPath)
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		if j := strings.Index(name[i:], "x."); j > 1 {
+			if dpr, err := strconv.ParseFloat(name[i+1:i+j], 64); err == nil {
+				return clampDpr(dpr), false
+			}
+		}
+	}
+	for _, header := range dprHeaders {
+		if dpr, err := strconv.ParseFloat(r.Header.Get(header), 64); err == nil {
+			return clampDpr(dpr), true
+		}
+	}
+	return 1, true
+}
+
+func clampDpr(dpr float64) float64 {
+	if !(dpr >= 1) {
+		return 1
+	} else if dpr > maxDpr {
+		return maxDpr
+	}
+	return dpr
+}
+
+// requestPriority runs speculative requests, such as prefetches, in the
+// background.
+func requestPriority(r *http.Request) optimizer.Priority {
+	purpose := r.Header.Get("Sec-Purpose")
+	if purpose == "" {
+		purpose = r.Header.Get("Purpose")
+	}
+	if strings.Contains(purpose, "prefetch") {
+		return optimizer.PriorityBackground
+	}
+	return optimizer.PriorityInteractive
+}
+
+func parseAcceptedTypes(acceptHeader string) ([]string, map[string]float64) {
 	acceptedTypes := make([]string, 0, 1)
+	preferences := make(map[string]float64)
 	for _, part := range strings.Split(acceptHeader, ",") {
 		acceptedType := part
+		q := 1.0
 		if strings.Contains(part, ";") {
-			acceptedType = strings.SplitN(part, ";", 2)[0]
+			params := strings.Split(part, ";")
+			acceptedType = params[0]
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						q = value
+					}
+				}
+			}
 		}
 		acceptedTypes = append(acceptedTypes, acceptedType)
+		preferences[strings.TrimSpace(acceptedType)] = q
 	}
-	return acceptedTypes
+	return acceptedTypes, preferences
 }
 
 var baseUrl = flag.String("baseurl", "", "Base url to which proxied requests are appended")
-var forceHidpi = flag.Bool("forceHidpi", false, "Force all image optimization to be done in hidpi mode")
+var forceHidpi = flag.Bool("forceHidpi", false, "Force all image optimization to be done for a device pixel ratio of at least 2")
+var strict = flag.Bool("strict", false, "Refuse to start if any optimizer is disabled or uses a fallback")
+var toolMemoryLimit = flag.Uint64("toolMemoryLimit", 2<<30, "Maximum address space in bytes of external tool processes")
+var toolCpuLimit = flag.Duration("toolCpuLimit", time.Minute, "Maximum cpu time of external tool processes")
+var toolTimeout = flag.Duration("toolTimeout", 2*time.Minute, "Maximum wall clock time of external tool processes")
+var toolNiceness = flag.Int("toolNiceness", 10, "Niceness of external tool processes")
+var toolConcurrency = flag.Int("toolConcurrency", runtime.NumCPU(), "Maximum number of concurrent processes of each external tool")
+var toolLimits = flag.String("toolLimits", "", "Per tool limits overriding the defaults, e.g. cwebp:memory=1G,cpu=30s,wall=1m,nice=10,concurrency=4;optipng:cpu=1m")
+var workDir = flag.String("workDir", "", "Directory for intermediate files, e.g. on a tmpfs (defaults to the system temp directory)")
+var workQuota = flag.Int64("workQuota", 256<<20, "Maximum number of bytes of intermediate files per optimized image")
+var maxWidth = flag.Int("maxWidth", 16384, "Maximum width of source images")
+var maxHeight = flag.Int("maxHeight", 16384, "Maximum height of source images")
+var maxPixels = flag.Int64("maxPixels", 50000000, "Maximum number of pixels of source images")
+var maxBytes = flag.Int64("maxBytes", 50<<20, "Maximum size in bytes of source images")
+var inputPolicy = flag.String("inputPolicy", "passthrough", "What to do with source images exceeding the limits: passthrough or reject")
+var workers = flag.Int("workers", runtime.NumCPU(), "Number of optimizers running at the same time")
+var queueSize = flag.Int("queueSize", 256, "Maximum number of optimizer runs waiting for a worker for each priority")
+var overloadPolicy = flag.String("overloadPolicy", "passthrough", "What to do when the queue is full: passthrough or reject")
+var requestTimeout = flag.Duration("requestTimeout", 10*time.Second, "Maximum time spent optimizing an image")
+var deadlineMargin = flag.Duration("deadlineMargin", 500*time.Millisecond, "Time before the request timeout at which the best result so far is used")
+var optimizerTimeout = flag.Duration("optimizerTimeout", 8*time.Second, "Maximum time a single optimizer is allowed to run")
+var scoring = flag.String("scoring", "", "Policies for choosing the served image, e.g. saving:bytes=1024,ratio=0.02;accept;decode:image/webp=0.1")
+var breakerThreshold = flag.Int("breakerThreshold", 5, "Number of consecutive failures after which an optimizer is skipped, 0 disables skipping")
+var breakerProbeInterval = flag.Duration("breakerProbeInterval", 30*time.Second, "Time after which a skipped optimizer is tried again")
+var searchStrategies = flag.String("searchStrategies", "", "Quality search strategies of the lossy optimizers, e.g. cwebp-lossy[image/png]=binary:min=0,max=100;mozjpeg-lossy[image/jpeg]=interpolation:tolerance=0.001")
+var metrics = flag.String("metrics", "", "Similarity metrics of the lossy optimizers overriding the defaults, e.g. cwebp-lossy[image/png]=alpha-ssim:threshold=0.998;mozjpeg-lossy[image/jpeg]=cw-ssim:threshold=0.99")
+var mozjpegSearchSpace = flag.String("mozjpegSearchSpace", "sample=2x2,1x1", "Encoder settings searched by the lossy mozjpeg optimizers, each setting multiplies the encoder runs, e.g. sample=2x2,1x1;qt=3,2;scan=progressive,baseline, empty for the cjpeg defaults")
+var searchParallelism = flag.Int("searchParallelism", 1, "Maximum number of qualities of an image tried at the same time on idle workers")
+var searchNeighbourhood = flag.Int("searchNeighbourhood", optimizer.DefaultNeighbourhood, "Number of qualities on each side of the chosen quality verified when scores are not monotonic in the quality, 0 disables verification")
+var debugReports = flag.Bool("debugReports", false, "Serve a JSON report of the optimization instead of the image to requests with the debug query parameter")
+var qualityStore = flag.String("qualityStore", "", "File in which the qualities chosen for images are remembered, disabled when empty")
+var maxEncodedSize = flag.Int64("maxEncodedSize", 8<<20, "Maximum size in bytes of optimized images compressed with a content encoding, larger images are sent unencoded")
+var capabilitiesPath = flag.String("capabilitiesPath", "/_capabilities", "Path on which the detected capabilities are served")
+
+var mozjpegFlags = map[string][]string{
+	"cjpeg": {"-quality", "-optimize", "-sample", "-quant-table", "-progressive", "-baseline"},
+}
 
 func main() {
 	flag.Parse()
@@ -47,27 +305,195 @@ func main() {
 	if _, err := url.Parse(*baseUrl); *baseUrl == "" || err != nil {
 		log.Fatalf("Invalid base url: %s", *baseUrl)
 	}
+	if *inputPolicy != "passthrough" && *inputPolicy != "reject" {
+		log.Fatalf("Invalid input policy: %s", *inputPolicy)
+	}
+	if *overloadPolicy != "passthrough" && *overloadPolicy != "reject" {
+		log.Fatalf("Invalid overload policy: %s", *overloadPolicy)
+	}
+
+	optimizer.DefaultPool = optimizer.NewTaskPool(*workers, *queueSize)
+	optimizer.DefaultPool.OptimizerTimeout = *optimizerTimeout
+	optimizer.DefaultPool.DeadlineMargin = *deadlineMargin
+	scoringPolicies, err := optimizer.ParseScoringPolicies(*scoring)
+	if err != nil {
+		log.Fatalf("Invalid scoring policies: %s", err)
+	}
+	optimizer.DefaultPool.ScoringFunc = optimizer.NewScoringFunc(scoringPolicies...)
+
+	inputLimits := optimizer.InputLimits{
+		MaxWidth:  *maxWidth,
+		MaxHeight: *maxHeight,
+		MaxPixels: *maxPixels,
+		MaxBytes:  *maxBytes,
+	}
+
+	perToolLimits, err := optimizer.ParseToolLimits(*toolLimits)
+	if err != nil {
+		log.Fatalf("Invalid tool limits: %s", err)
+	}
+	optimizer.DefaultExecutor = &optimizer.OsExecutor{
+		DefaultLimits: optimizer.ToolLimits{
+			AddressSpace: *toolMemoryLimit,
+			CPUTime:      *toolCpuLimit,
+			WallClock:    *toolTimeout,
+			Niceness:     *toolNiceness,
+			Concurrency:  *toolConcurrency,
+		},
+		ToolLimits: perToolLimits,
+	}
+
+	optimizer.DefaultWorkspaceDir = *workDir
+	optimizer.DefaultWorkspaceQuota = *workQuota
+	optimizer.MaxEncodedSize = *maxEncodedSize
+
+	searchSpace, err := optimizer.ParseMozjpegSearchSpace(*mozjpegSearchSpace)
+	if err != nil {
+		log.Fatalf("Invalid mozjpeg search space: %s", err)
+	}
 
 	optimizers := []optimizer.ImageOptimizer{
-		&optimizer.WebpLosslessOptimizer{
-			Args: []string{},
+		&optimizer.FallbackOptimizer{
+			Name: "cwebp-lossless",
+			Optimizer: &optimizer.WebpLosslessOptimizer{
+				Args: []string{},
+			},
+			Tools: []string{"cwebp"},
+			Flags: map[string][]string{"cwebp": {"-lossless"}},
+		},
+		&optimizer.FallbackOptimizer{
+			Name:      "cwebp-lossy[image/png]",
+			Optimizer: optimizer.NewWebpLossyPngOptimizer(&optimizer.AlphaSsimMetric{MinScore: 0.998}, optimizer.DefaultExecutor),
+			Tools:     []string{"cwebp"},
+			Flags:     map[string][]string{"cwebp": {"-q", "-alpha_q"}},
+		},
+		&optimizer.FallbackOptimizer{
+			Name:      "cwebp-lossy[image/jpeg]",
+			Optimizer: optimizer.NewWebpLossyJpegOptimizer(&optimizer.AlphaSsimMetric{MinScore: 0.995}, optimizer.DefaultExecutor),
+			Tools:     []string{"cwebp"},
+			Flags:     map[string][]string{"cwebp": {"-q", "-alpha_q"}},
+		},
+		&optimizer.FallbackOptimizer{
+			Name: "optipng",
+			Optimizer: &optimizer.OptipngOptimizer{
+				Args: []string{"-strip", "all"},
+			},
+			Fallback: &optimizer.NativePngOptimizer{
+				CompressionLevel: png.BestCompression,
+			},
+			Tools: []string{"optipng"},
+			Flags: map[string][]string{"optipng": {"-out", "-strip"}},
+		},
+		&optimizer.FallbackOptimizer{
+			Name: "mozjpeg",
+			Optimizer: &optimizer.MozjpegOptimizer{
+				Args: []string{"-copy", "none", "-optimize"},
+			},
+			Tools: []string{"jpegtran"},
+			Flags: map[string][]string{"jpegtran": {"-copy", "-optimize"}},
 		},
-		optimizer.NewWebpLossyPngOptimizer(0.998),
-		optimizer.NewWebpLossyJpegOptimizer(0.995),
-		&optimizer.OptipngOptimizer{
-			Args: []string{"-strip", "all"},
+		&optimizer.FallbackOptimizer{
+			Name:      "mozjpeg-lossy[image/png]",
+			Optimizer: optimizer.NewMozjpegPngLossyOptimizer(&optimizer.SsimMetric{MinScore: 0.997}, searchSpace, optimizer.DefaultExecutor),
+			Fallback:  optimizer.NewNativePngLossyOptimizer(&optimizer.SsimMetric{MinScore: 0.997}),
+			Tools:     []string{"cjpeg"},
+			Flags:     mozjpegFlags,
 		},
-		&optimizer.MozjpegOptimizer{
-			Args: []string{"-copy", "none", "-optimize"},
+		&optimizer.FallbackOptimizer{
+			Name:      "mozjpeg-lossy[image/jpeg]",
+			Optimizer: optimizer.NewMozjpegLossyOptimizer(&optimizer.SsimMetric{MinScore: 0.994}, searchSpace, optimizer.DefaultExecutor),
+			Fallback:  optimizer.NewNativeJpegLossyOptimizer(&optimizer.SsimMetric{MinScore: 0.994}),
+			Tools:     []string{"cjpeg"},
+			Flags:     mozjpegFlags,
+		},
+		&optimizer.SvgOptimizer{
+			Precision: 3,
 		},
-		optimizer.NewMozjpegPngLossyOptimizer(0.997),
-		optimizer.NewMozjpegLossyOptimizer(0.994),
+	}
+
+	var store optimizer.QualityStore
+	if *qualityStore != "" {
+		store, err = optimizer.NewFileQualityStore(*qualityStore)
+		if err != nil {
+			log.Fatalf("Could not open quality store: %s", err)
+		}
+	}
+
+	strategies, err := parseSearchStrategies(*searchStrategies)
+	if err != nil {
+		log.Fatalf("Invalid search strategies: %s", err)
+	}
+	metricsByName, err := parseMetrics(*metrics)
+	if err != nil {
+		log.Fatalf("Invalid metrics: %s", err)
+	}
+	for _, opt := range optimizers {
+		fallbackOptimizer, ok := opt.(*optimizer.FallbackOptimizer)
+		if !ok {
+			continue
+		}
+		strategy, hasStrategy := strategies[string(fallbackOptimizer.Name)]
+		metric, hasMetric := metricsByName[string(fallbackOptimizer.Name)]
+		for _, o := range []optimizer.ImageOptimizer{fallbackOptimizer.Optimizer, fallbackOptimizer.Fallback} {
+			if automaticOptimizer, ok := o.(*optimizer.AutomaticOptimizer); ok {
+				automaticOptimizer.Parallelism = *searchParallelism
+				automaticOptimizer.Neighbourhood = *searchNeighbourhood
+				if *searchNeighbourhood == 0 {
+					automaticOptimizer.Neighbourhood = -1
+				}
+				automaticOptimizer.Store = store
+				if hasStrategy {
+					automaticOptimizer.Strategy = strategy
+				}
+				if hasMetric {
+					automaticOptimizer.Metric = metric
+				}
+			}
+		}
+		delete(strategies, string(fallbackOptimizer.Name))
+		delete(metricsByName, string(fallbackOptimizer.Name))
+	}
+	for name := range strategies {
+		log.Fatalf("Search strategy for unknown optimizer %s", name)
+	}
+	for name := range metricsByName {
+		log.Fatalf("Metric for unknown optimizer %s", name)
+	}
+
+	caps := optimizer.ProbeCapabilities(context.Background(), optimizer.DefaultExecutor, optimizer.DefaultToolSpecs)
+	for _, tool := range caps.Tools {
+		if tool.Available {
+			log.Printf("Found %s: %s (%s)", tool.Name, tool.Path, tool.Version)
+		} else {
+			log.Printf("Tool %s not available", tool.Name)
+		}
+	}
+	optimizer.DefaultTranscoders = optimizer.CheckTranscoders(optimizer.DefaultTranscoders, caps)
+	for _, status := range optimizer.CheckOptimizers(optimizers, caps) {
+		if *strict && status.Status != optimizer.StatusEnabled {
+			log.Fatalf("Optimizer %s is %s: %s", status.Name, status.Status, status.Reason)
+		}
+	}
+	for i, opt := range optimizers {
+		optimizers[i] = &optimizer.CircuitBreaker{
+			Optimizer:     opt,
+			Threshold:     *breakerThreshold,
+			ProbeInterval: *breakerProbeInterval,
+		}
 	}
 
 	client := &http.Client{}
 
+	http.HandleFunc(*capabilitiesPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(caps)
+		if err != nil {
+			log.Printf("Could not encode capabilities err=%s", err)
+		}
+	})
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		acceptedTypes := parseAcceptedTypes(r.Header.Get("Accept"))
+		acceptedTypes, typePreferences := parseAcceptedTypes(r.Header.Get("Accept"))
 
 		requestUrl, err := url.ParseRequestURI(r.RequestURI)
 		if err != nil {
@@ -75,9 +501,19 @@ func main() {
 			return
 		}
 
-		hidpi := *forceHidpi || strings.Contains(requestUrl.Path, "@2x.")
+		budget, err := parseByteBudget(requestUrl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		debug := *debugReports && parseDebug(requestUrl)
+		dpr, dprHinted := requestDpr(r, requestUrl.Path)
+		if *forceHidpi && dpr < 2 {
+			dpr = 2
+		}
 
-		log.Printf("Proxying: %s (hidpi=%t)", requestUrl.Path+"?"+requestUrl.RawQuery, hidpi)
+		log.Printf("Proxying: %s (dpr=%g)", requestUrl.Path+"?"+requestUrl.RawQuery, dpr)
 
 		req, err := http.NewRequest(http.MethodGet, *baseUrl+requestUrl.Path+"?"+requestUrl.RawQuery, nil)
 		if err != nil {
@@ -96,52 +532,96 @@ func main() {
 		}
 		defer resp.Body.Close()
 
-		if !optimizer.CanOptimize(optimizers, resp.Header.Get("Content-Type"), acceptedTypes) {
-			for key, vals := range resp.Header {
-				for _, val := range vals {
-					w.Header().Add(key, val)
-				}
-			}
-			w.WriteHeader(resp.StatusCode)
-			_, err = io.Copy(w, resp.Body)
-			if err != nil {
-				reportError(w, "Could not copy data to client", err)
-				return
+		contentType := optimizer.MediaType(resp.Header.Get("Content-Type"))
+		if !optimizer.CanOptimize(optimizers, contentType, acceptedTypes) {
+			if resp.ContentLength >= 0 {
+				reportBudget(w, budget, resp.ContentLength)
 			}
+			copyResponse(w, resp, resp.Body, false)
+			return
+		}
+
+		if err := optimizer.CheckInputSize(resp.ContentLength, inputLimits); err != nil {
+			handleRejectedInput(w, resp, resp.Body, false, err)
 			return
 		}
 
-		tempFile, err := ioutil.TempFile(os.TempDir(), strings.Replace(r.RequestURI, "/", "", -1))
+		body, err := optimizer.DecodeContent(resp.Body, resp.Header.Get("Content-Encoding"))
 		if err != nil {
-			reportError(w, "Could not create temp file", err)
+			reportError(w, "Could not decode response body", err)
 			return
 		}
-		defer tempFile.Close()
 
-		_, err = io.Copy(tempFile, resp.Body)
+		limitedBody := body
+		if inputLimits.MaxBytes > 0 {
+			limitedBody = io.LimitReader(body, inputLimits.MaxBytes+1)
+		}
+		source, err := ioutil.ReadAll(limitedBody)
 		if err != nil {
-			reportError(w, "Could not copy data to temp file", err)
+			reportError(w, "Could not read response body", err)
+			return
+		}
+		if err := optimizer.CheckInputSize(int64(len(source)), inputLimits); err != nil {
+			handleRejectedInput(w, resp, io.MultiReader(bytes.NewReader(source), body), true, err)
 			return
 		}
 
-		optimizedImage, err := optimizer.Optimize(r.Context(), optimizers, optimizer.OptimizeParams{
-			AcceptedTypes: acceptedTypes,
-			SourcePath:    tempFile.Name(),
-			Hidpi:         hidpi,
+		ctx, cancel := context.WithTimeout(r.Context(), *requestTimeout)
+		defer cancel()
+
+		result, err := optimizer.Optimize(ctx, optimizers, optimizer.OptimizeParams{
+			AcceptedTypes:   acceptedTypes,
+			TypePreferences: typePreferences,
+			SourceData:      source,
+			ContentType:     contentType,
+			Dpr:             dpr,
+			InputLimits:     inputLimits,
+			Priority:        requestPriority(r),
+			ByteBudget:      budget,
 		})
+		if debug {
+			writeDebugReport(w, newDebugReport(contentType, source, result, err))
+			return
+		}
 		if err != nil {
-			reportError(w, "Could not optimize the file", err)
+			reportBudget(w, budget, int64(len(source)))
+			handleOptimizeError(w, resp, source, err)
 			return
 		}
+		for _, failure := range result.Failures {
+			log.Printf("Optimizer failed optimizer=%s kind=%s err=%s", failure.Optimizer, optimizer.ErrorKind(failure), failure.Err)
+		}
 
+		optimizedImage := result.Image
 		log.Printf("Chosen optimizer: %s", optimizedImage.Optimizer)
+		if result.BudgetExceeded {
+			log.Printf("No image fits into the budget of %d bytes", budget.Bytes)
+		}
+
+		if dprHinted {
+			w.Header().Add("Vary", strings.Join(dprHeaders, ", "))
+		}
+		if optimizer.IsCompressible(optimizedImage.MimeType) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := optimizer.NegotiateEncoding(r.Header.Get("Accept-Encoding"))
+			optimizedImage, err = optimizer.EncodeContent(optimizedImage, encoding)
+			if err != nil {
+				reportError(w, "Could not encode the file", err)
+				return
+			}
+		}
 
-		file, err := os.Open(optimizedImage.Path)
+		file, err := optimizedImage.Open()
 		if err != nil {
 			reportError(w, "opening file", err)
 			return
 		}
+		defer file.Close()
+		reportBudget(w, budget, optimizedImage.Size)
 		w.Header().Set("Content-Type", optimizedImage.MimeType)
+		if optimizedImage.ContentEncoding != "" {
+			w.Header().Set("Content-Encoding", optimizedImage.ContentEncoding)
+		}
 		w.Header().Set("Content-Length", strconv.FormatInt(optimizedImage.Size, 10))
 		w.WriteHeader(http.StatusOK)
 
@@ -3,60 +3,452 @@ package optimizer
 import (
 	"context"
 	"log"
+	"sync"
 )
 
 type ImageQualityOptimizer interface {
-	OptimizePrecheck(ctx context.Context, sourcePath string) (bool, error)
-	OptimizeQuality(ctx context.Context, sourcePath string, quality int) (*ImageDescription, error)
-	CompareImages(ctx context.Context, sourcePath string, imageDesc *ImageDescription, hidpi bool) (float64, error)
+	OptimizePrecheck(ctx context.Context, source *ImageDescription) (bool, error)
+	OptimizeQuality(ctx context.Context, source *ImageDescription, quality int) (*ImageDescription, error)
 	ImageOptimizer
 }
 
+// SourceQualityLimiter is implemented by quality optimizers that gain nothing
+// from qualities above the quality the source was encoded with.
+type SourceQualityLimiter interface {
+	// MaxQuality returns the highest quality worth trying for the source.
+	MaxQuality(source *ImageDescription) (int, bool)
+}
+
+// SourcePreparer is implemented by quality optimizers that convert the source
+// before encoding it. The conversion is done once and the prepared source is
+// given to OptimizeQuality for all the qualities and variants tried.
+type SourcePreparer interface {
+	PrepareSource(ctx context.Context, source *ImageDescription) (*ImageDescription, func(), error)
+}
+
+// VariantOptimizer is implemented by quality optimizers that can encode an
+// image with several encoder configurations. The quality is searched for each
+// of the variants and the smallest result is used.
+type VariantOptimizer interface {
+	Variants() []ImageQualityOptimizer
+}
+
 var _ ImageOptimizer = &AutomaticOptimizer{}
 
 type AutomaticOptimizer struct {
 	Optimizer ImageQualityOptimizer
-	MinSsim   float64
+	// Metric comparing the outputs to the source, the smallest output
+	// reaching its threshold is chosen.
+	Metric Metric
+	// Strategy used to search for the quality, DefaultSearchStrategy when nil.
+	Strategy SearchStrategy
+	// Maximum number of qualities tried at the same time when the strategy
+	// supports it. Additional qualities are only tried on idle workers of the
+	// pool running the optimizer.
+	Parallelism int
+	// Strategy used to search for the quality with a byte budget,
+	// DefaultBudgetStrategy when nil.
+	BudgetStrategy SearchStrategy
+	// Remembers the chosen qualities, the search is skipped when the
+	// remembered quality still reaches the threshold of the metric.
+	Store QualityStore
+	// Number of qualities on each side of the boundary tried when the scores
+	// or sizes of the probes are not monotonic in the quality,
+	// DefaultNeighbourhood when zero and none when negative.
+	Neighbourhood int
+}
+
+const DefaultNeighbourhood = 2
+
+// Maximum number of times the neighbourhood is verified again after the
+// boundary moved down.
+const maxNeighbourRounds = 3
+
+// ByteBudget asks for the output of the highest quality that is not larger
+// than Bytes instead of the smallest output reaching the score threshold.
+type ByteBudget struct {
+	Bytes int64
+	// Minimum score of the output measured by the metric of the optimizer,
+	// zero for none.
+	MinScore float64
+}
+
+type byteBudgetKey struct{}
+
+func withByteBudget(ctx context.Context, budget ByteBudget) context.Context {
+	return context.WithValue(ctx, byteBudgetKey{}, budget)
+}
+
+func byteBudgetFrom(ctx context.Context) ByteBudget {
+	budget, _ := ctx.Value(byteBudgetKey{}).(ByteBudget)
+	return budget
 }
 
 func (o *AutomaticOptimizer) CanOptimize(mimeType string, acceptedTypes []string) bool {
 	return o.Optimizer.CanOptimize(mimeType, acceptedTypes)
 }
 
-func (o *AutomaticOptimizer) Optimize(ctx context.Context, sourcePath string, hidpi bool) (*ImageDescription, error) {
-	ok, err := o.Optimizer.OptimizePrecheck(ctx, sourcePath)
+func (o *AutomaticOptimizer) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	ok, err := o.Optimizer.OptimizePrecheck(ctx, source)
 	if err != nil {
 		return nil, err
 	} else if !ok {
 		return nil, nil
 	}
 
-	var best *ImageDescription
-	qualityMax := 100
-	qualityMin := 0
-	for qualityMax-qualityMin >= 0 {
-		log.Println(qualityMin, qualityMax)
-		quality := (qualityMax + qualityMin) / 2
-		log.Printf("Trying quality %d", quality)
-
-		imageDesc, err := o.Optimizer.OptimizeQuality(ctx, sourcePath, quality)
+	var hash *sourceHash
+	if o.Store != nil {
+		hash = sourceHashFrom(ctx)
+	}
+	comparison, err := newComparison(source, dpr, o.Metric, hash)
+	if err != nil {
+		return nil, &ComparisonError{Err: err}
+	}
+
+	maxQuality := 100
+	if limiter, ok := o.Optimizer.(SourceQualityLimiter); ok {
+		if quality, ok := limiter.MaxQuality(source); ok {
+			log.Printf("Limiting quality to %d of the source", quality)
+			maxQuality = quality
+		}
+	}
+
+	input := source
+	if preparer, ok := o.Optimizer.(SourcePreparer); ok {
+		prepared, cleanup, err := preparer.PrepareSource(ctx, source)
 		if err != nil {
 			return nil, err
 		}
+		defer cleanup()
+		input = prepared
+	}
 
-		score, err := o.Optimizer.CompareImages(ctx, sourcePath, imageDesc, hidpi)
+	variants := []ImageQualityOptimizer{o.Optimizer}
+	if variantOptimizer, ok := o.Optimizer.(VariantOptimizer); ok {
+		variants = variantOptimizer.Variants()
+	}
+
+	budget := byteBudgetFrom(ctx)
+	workspace := workspaceFrom(ctx)
+	var best *ImageDescription
+	var bestScore float64
+	for _, variant := range variants {
+		imageDesc, score, err := o.search(ctx, variant, input, comparison, budget, maxQuality)
 		if err != nil {
+			workspace.Discard(best)
 			return nil, err
 		}
-		log.Printf("ssim = %f", score)
-		if score < o.MinSsim {
-			qualityMin = quality + 1
-		} else {
-			qualityMax = quality - 1
-			log.Printf("Using quality %d", quality)
+		if imageDesc == nil {
+			continue
+		}
+		if best == nil || (budget.Bytes > 0 && score > bestScore) || (budget.Bytes <= 0 && imageDesc.Size < best.Size) {
+			workspace.Discard(best)
 			best = imageDesc
+			bestScore = score
+		} else {
+			workspace.Discard(imageDesc)
 		}
 	}
+	if best != nil {
+		log.Printf("Using variant %s", best.Optimizer)
+	}
 
 	return best, nil
 }
+
+// search looks for the smallest output reaching the threshold of the metric
+// or, with a byte budget, for the output of the highest quality fitting into
+// the budget. For the budget the strategy is given the sizes of the probes as
+// scores and looks for the lowest quality exceeding the budget.
+func (o *AutomaticOptimizer) search(ctx context.Context, optimizer ImageQualityOptimizer, source *ImageDescription, comparison *Comparison, budget ByteBudget, maxQuality int) (*ImageDescription, float64, error) {
+	strategy := o.Strategy
+	if strategy == nil {
+		strategy = DefaultSearchStrategy
+	}
+	threshold := o.Metric.Threshold()
+	if budget.Bytes > 0 {
+		strategy = o.BudgetStrategy
+		if strategy == nil {
+			strategy = DefaultBudgetStrategy
+		}
+		threshold = float64(budget.Bytes + 1)
+	}
+	if maxQuality < 100 {
+		strategy = limitStrategy(strategy, maxQuality)
+	}
+
+	var key QualityKey
+	if o.Store != nil && budget.Bytes <= 0 {
+		key = QualityKey{
+			Hash:      comparison.SourceHash(),
+			Optimizer: optimizerName(optimizer),
+			Dpr:       comparison.dpr,
+			Metric:    metricName(o.Metric),
+		}
+		imageDesc, score, err := o.verify(ctx, optimizer, source, comparison, key)
+		if err != nil || imageDesc != nil {
+			return imageDesc, score, err
+		}
+	}
+	parallelStrategy, _ := strategy.(ParallelSearchStrategy)
+	pool := poolFrom(ctx)
+
+	reached := func(result *probeResult) bool {
+		if budget.Bytes > 0 {
+			return result.desc.Size > budget.Bytes
+		}
+		return result.score >= o.Metric.Threshold()
+	}
+
+	workspace := workspaceFrom(ctx)
+	trace := probeTraceFrom(ctx)
+	name := optimizerName(optimizer)
+	var best *ImageDescription
+	var bestProbe Probe
+	probes := make([]Probe, 0, 8)
+	strategyProbes := make([]Probe, 0, 8)
+	record := func(result *probeResult, neighbour bool) {
+		log.Printf("quality = %d score = %f size = %d", result.quality, result.score, result.desc.Size)
+		probe := Probe{
+			Quality:   result.quality,
+			Score:     result.score,
+			Size:      result.desc.Size,
+			Optimizer: name,
+			Reached:   reached(result),
+			Neighbour: neighbour,
+		}
+		probes = append(probes, probe)
+		trace.add(probe)
+		strategyProbe := probe
+		if budget.Bytes > 0 {
+			strategyProbe.Score = float64(probe.Size)
+		}
+		strategyProbes = append(strategyProbes, strategyProbe)
+
+		var better bool
+		if budget.Bytes > 0 {
+			better = !probe.Reached && result.score >= budget.MinScore && (best == nil || probe.Quality > bestProbe.Quality)
+		} else {
+			better = probe.Reached && (best == nil || probe.Size < best.Size)
+		}
+		if better {
+			workspace.Discard(best)
+			best = result.desc
+			bestProbe = probe
+		} else {
+			workspace.Discard(result.desc)
+		}
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			workspace.Discard(best)
+			return nil, 0, err
+		}
+
+		var qualities []int
+		borrowed := 0
+		if parallelStrategy != nil && o.Parallelism > 1 {
+			borrowed = pool.borrow(o.Parallelism - 1)
+			qualities = parallelStrategy.NextN(strategyProbes, threshold, borrowed+1)
+		} else if quality, ok := strategy.Next(strategyProbes, threshold); ok {
+			qualities = []int{quality}
+		}
+		if len(qualities) == 0 {
+			pool.release(borrowed)
+			break
+		}
+		log.Printf("Trying qualities %v", qualities)
+
+		results := o.probe(ctx, optimizer, source, comparison, qualities, reached)
+		pool.release(borrowed)
+
+		var err error
+		for i := range results {
+			result := &results[i]
+			if result.err != nil {
+				if !result.irrelevant && err == nil {
+					err = result.err
+				}
+				continue
+			}
+			record(result, false)
+		}
+		if err != nil {
+			workspace.Discard(best)
+			return nil, 0, err
+		}
+	}
+
+	if budget.Bytes <= 0 {
+		minQuality, maxQuality := strategyRange(strategy, maxQuality)
+		o.verifyNeighbours(ctx, optimizer, source, comparison, minQuality, maxQuality, &probes, record)
+	}
+	log.Printf("Search of %s done after %d probes: %v", name, len(probes), probes)
+
+	if best == nil {
+		return nil, 0, nil
+	}
+	best.Probes = probes
+	if key.Hash != "" {
+		err := o.Store.Put(key, QualityRecord{
+			Quality: bestProbe.Quality,
+			Score:   bestProbe.Score,
+		})
+		if err != nil {
+			log.Printf("Could not remember quality of %s err=%s", key.Optimizer, err)
+		}
+	}
+	return best, bestProbe.Score, nil
+}
+
+// verifyNeighbours tries the qualities of the searched range around the
+// boundary of a search whose probes are not monotonic, as the search may have
+// skipped over lower qualities reaching the threshold or smaller outputs. The
+// neighbourhood of the boundary is tried again while the boundary moves down,
+// up to maxNeighbourRounds times. Failed probes end the verification, the
+// outputs verified so far remain valid.
+func (o *AutomaticOptimizer) verifyNeighbours(ctx context.Context, optimizer ImageQualityOptimizer, source *ImageDescription, comparison *Comparison, minQuality, maxQuality int, probes *[]Probe, record func(*probeResult, bool)) {
+	distance := o.Neighbourhood
+	if distance == 0 {
+		distance = DefaultNeighbourhood
+	}
+	if distance < 0 || monotonic(*probes) {
+		return
+	}
+
+	pool := poolFrom(ctx)
+	for round := 0; round < maxNeighbourRounds; round++ {
+		qualities := neighbours(*probes, distance, minQuality, maxQuality)
+		if len(qualities) == 0 {
+			return
+		}
+		log.Printf("Probes of %s are not monotonic, verifying qualities %v", optimizerName(optimizer), qualities)
+
+		for len(qualities) > 0 {
+			borrowed := 0
+			if o.Parallelism > 1 {
+				borrowed = pool.borrow(o.Parallelism - 1)
+			}
+			n := borrowed + 1
+			if n > len(qualities) {
+				n = len(qualities)
+			}
+			results := o.probe(ctx, optimizer, source, comparison, qualities[:n], nil)
+			pool.release(borrowed)
+			qualities = qualities[n:]
+
+			failed := false
+			for i := range results {
+				if results[i].err != nil {
+					log.Printf("Could not verify quality %d of %s err=%s", results[i].quality, optimizerName(optimizer), results[i].err)
+					failed = true
+					continue
+				}
+				record(&results[i], true)
+			}
+			if failed {
+				return
+			}
+		}
+	}
+}
+
+// verify tries the remembered quality and returns its output when it still
+// reaches the threshold of the metric.
+func (o *AutomaticOptimizer) verify(ctx context.Context, optimizer ImageQualityOptimizer, source *ImageDescription, comparison *Comparison, key QualityKey) (*ImageDescription, float64, error) {
+	record, ok := o.Store.Get(key)
+	if !ok {
+		return nil, 0, nil
+	}
+
+	imageDesc, score, err := o.probeQuality(ctx, optimizer, source, comparison, record.Quality)
+	if err != nil {
+		return nil, 0, err
+	}
+	probe := Probe{
+		Quality:   record.Quality,
+		Score:     score,
+		Size:      imageDesc.Size,
+		Optimizer: key.Optimizer,
+		Reached:   score >= o.Metric.Threshold(),
+	}
+	probeTraceFrom(ctx).add(probe)
+	if !probe.Reached {
+		log.Printf("Remembered quality %d of %s no longer reaches the threshold (score = %f)", record.Quality, key.Optimizer, score)
+		workspaceFrom(ctx).Discard(imageDesc)
+		return nil, 0, nil
+	}
+
+	log.Printf("Using remembered quality %d of %s", record.Quality, key.Optimizer)
+	imageDesc.Probes = []Probe{probe}
+	return imageDesc, score, nil
+}
+
+type probeResult struct {
+	quality int
+	desc    *ImageDescription
+	score   float64
+	err     error
+	// Set when the probe was cancelled because another probe made its
+	// result irrelevant.
+	irrelevant bool
+}
+
+// probe tries the qualities at the same time. Once a quality reaches the goal
+// of the search the probes of higher qualities are cancelled, once a quality
+// falls short the probes of lower qualities are. Without reached all the
+// qualities are tried.
+func (o *AutomaticOptimizer) probe(ctx context.Context, optimizer ImageQualityOptimizer, source *ImageDescription, comparison *Comparison, qualities []int, reached func(*probeResult) bool) []probeResult {
+	results := make([]probeResult, len(qualities))
+	contexts := make([]context.Context, len(qualities))
+	cancels := make([]context.CancelFunc, len(qualities))
+	for i, quality := range qualities {
+		results[i].quality = quality
+		contexts[i], cancels[i] = context.WithCancel(ctx)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := range qualities {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result := &results[i]
+			result.desc, result.score, result.err = o.probeQuality(contexts[i], optimizer, source, comparison, result.quality)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if result.err != nil || reached == nil {
+				return
+			}
+			for j := range results {
+				passed := reached(result)
+				if (passed && results[j].quality > result.quality) || (!passed && results[j].quality < result.quality) {
+					results[j].irrelevant = true
+					cancels[j]()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return results
+}
+
+func (o *AutomaticOptimizer) probeQuality(ctx context.Context, optimizer ImageQualityOptimizer, source *ImageDescription, comparison *Comparison, quality int) (*ImageDescription, float64, error) {
+	imageDesc, err := optimizer.OptimizeQuality(ctx, source, quality)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	score, err := comparison.Compare(imageDesc)
+	if err != nil {
+		workspaceFrom(ctx).Discard(imageDesc)
+		return nil, 0, &ComparisonError{Err: err}
+	}
+	return imageDesc, score, nil
+}
@@ -0,0 +1,130 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"reflect"
+	"testing"
+)
+
+// grayQualityOptimizer encodes the quality as the color of a single pixel.
+type grayQualityOptimizer struct {
+	qualities []int
+}
+
+func (o *grayQualityOptimizer) CanOptimize(mimeType string, acceptedTypes []string) bool {
+	return true
+}
+
+func (o *grayQualityOptimizer) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	return nil, nil
+}
+
+func (o *grayQualityOptimizer) OptimizePrecheck(ctx context.Context, source *ImageDescription) (bool, error) {
+	return true, nil
+}
+
+func (o *grayQualityOptimizer) OptimizeQuality(ctx context.Context, source *ImageDescription, quality int) (*ImageDescription, error) {
+	o.qualities = append(o.qualities, quality)
+	return grayPng(uint8(quality))
+}
+
+func grayPng(y uint8) (*ImageDescription, error) {
+	img := image.NewGray(image.Rect(0, 0, 1, 1))
+	img.SetGray(0, 0, color.Gray{Y: y})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return describeData("gray", buf.Bytes(), "image/png"), nil
+}
+
+// holeMetric scores all qualities but the failing ones as identical.
+type holeMetric struct {
+	failing []int
+}
+
+func (m *holeMetric) Prepare(source image.Image) MetricReference {
+	return m
+}
+
+func (m *holeMetric) Threshold() float64 {
+	return 0.5
+}
+
+func (m *holeMetric) Score(img image.Image) float64 {
+	if containsQuality(m.failing, int(img.(*image.Gray).GrayAt(0, 0).Y)) {
+		return 0
+	}
+	return 1
+}
+
+// fixedStrategy tries the qualities in order.
+type fixedStrategy []int
+
+func (s fixedStrategy) Next(probes []Probe, threshold float64) (int, bool) {
+	if len(probes) >= len(s) {
+		return 0, false
+	}
+	return s[len(probes)], true
+}
+
+// rangedStrategy tries the qualities in order within the range min..max.
+type rangedStrategy struct {
+	fixedStrategy
+	min, max int
+}
+
+func (s *rangedStrategy) Range() (int, int) {
+	return s.min, s.max
+}
+
+func (s *rangedStrategy) WithMax(max int) SearchStrategy {
+	return s
+}
+
+func TestVerifyNeighboursRounds(t *testing.T) {
+	ctx, cleanup := testWorkspace(t)
+	defer cleanup()
+	source, err := grayPng(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		strategy      SearchStrategy
+		wantQualities []int
+	}{
+		{
+			name:     "rounds are capped",
+			strategy: fixedStrategy{90, 80, 70},
+			wantQualities: []int{90, 80, 70,
+				68, 69, 71, 72,
+				66, 67,
+				64, 65},
+		},
+		{
+			name:          "neighbours stay in the range",
+			strategy:      &rangedStrategy{fixedStrategy{90, 80, 71}, 70, 90},
+			wantQualities: []int{90, 80, 71, 70, 72, 73},
+		},
+	}
+	for _, test := range tests {
+		opt := &grayQualityOptimizer{}
+		optimizer := &AutomaticOptimizer{
+			Optimizer: opt,
+			Metric:    &holeMetric{failing: []int{80, 72}},
+			Strategy:  test.strategy,
+		}
+		if _, err := optimizer.Optimize(ctx, source, 1); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(opt.qualities, test.wantQualities) {
+			t.Errorf("%s: got qualities %v, want %v", test.name, opt.qualities, test.wantQualities)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package optimizer
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"image"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+var (
+	// State of the circuit breakers by optimizer name.
+	circuitBreakerStates = expvar.NewMap("circuit_breaker_states")
+	// Number of times the circuit breakers opened by optimizer name.
+	circuitBreakerTrips = expvar.NewMap("circuit_breaker_trips")
+)
+
+// CircuitOpenError is returned when an optimizer is skipped because its
+// circuit breaker is open.
+type CircuitOpenError struct {
+	Optimizer string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return "circuit breaker of " + e.Optimizer + " is open"
+}
+
+var _ ImageOptimizer = &CircuitBreaker{}
+
+// CircuitBreaker stops using the optimizer after a number of consecutive
+// failures or timeouts. While the circuit is open the optimizer is not used,
+// every ProbeInterval a single run is let through and the circuit closes when
+// it succeeds. Only failures pointing at the tool are counted, failures caused
+// by the source or its size are not.
+type CircuitBreaker struct {
+	// Name used in logs and metrics, defaults to the name of the optimizer.
+	Name      Name
+	Optimizer ImageOptimizer
+	// Number of consecutive failures opening the circuit, zero disables the
+	// circuit breaker.
+	Threshold     int
+	ProbeInterval time.Duration
+
+	init     sync.Once
+	state    *expvar.String
+	mu       sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	probing  bool
+}
+
+func (b *CircuitBreaker) name() string {
+	if b.Name != "" {
+		return string(b.Name)
+	}
+	return optimizerName(b.Optimizer)
+}
+
+func (b *CircuitBreaker) setState(state string) {
+	b.init.Do(func() {
+		b.state = new(expvar.String)
+		circuitBreakerStates.Set(b.name(), b.state)
+	})
+	b.state.Set(state)
+}
+
+// probeDue reports whether an open circuit should let a run through.
+func (b *CircuitBreaker) probeDue() bool {
+	return !b.probing && time.Since(b.openedAt) >= b.ProbeInterval
+}
+
+func (b *CircuitBreaker) CanOptimize(mimeType string, acceptedTypes []string) bool {
+	b.mu.Lock()
+	available := !b.open || b.probeDue()
+	b.mu.Unlock()
+	return available && b.Optimizer.CanOptimize(mimeType, acceptedTypes)
+}
+
+func (b *CircuitBreaker) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	probe, ok := b.allow()
+	if !ok {
+		return nil, &CircuitOpenError{Optimizer: b.name()}
+	}
+	desc, err := b.Optimizer.Optimize(ctx, source, dpr)
+	b.record(probe, err != nil && ctx.Err() == nil && toolFailure(source, err), err)
+	return desc, err
+}
+
+func (b *CircuitBreaker) allow() (probe bool, ok bool) {
+	if b.Threshold <= 0 {
+		return false, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return false, true
+	}
+	if !b.probeDue() {
+		return false, false
+	}
+	b.probing = true
+	b.setState("half-open")
+	log.Printf("Circuit breaker of %s probing", b.name())
+	return true, true
+}
+
+func (b *CircuitBreaker) record(probe bool, counted bool, err error) {
+	if b.Threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+
+	if err == nil {
+		if b.open {
+			log.Printf("Circuit breaker of %s closed", b.name())
+		}
+		b.failures = 0
+		b.open = false
+		b.setState("closed")
+		return
+	}
+	if !counted {
+		if probe {
+			b.setState("open")
+		}
+		return
+	}
+
+	b.failures++
+	if b.open {
+		if probe {
+			b.openedAt = time.Now()
+			b.setState("open")
+			log.Printf("Circuit breaker of %s probe failed err=%s", b.name(), err)
+		}
+	} else if b.failures >= b.Threshold {
+		b.open = true
+		b.openedAt = time.Now()
+		b.setState("open")
+		circuitBreakerTrips.Add(b.name(), 1)
+		log.Printf("Circuit breaker of %s opened after %d failures err=%s", b.name(), b.failures, err)
+	}
+}
+
+// toolFailure reports whether the error points at the tool rather than at the
+// source. Resource limits and timeouts are reached by large sources and tools
+// exiting with an error are only blamed when the source decodes cleanly.
+func toolFailure(source *ImageDescription, err error) bool {
+	if ErrorKind(err) == "tool_missing" {
+		return true
+	}
+	execErr := unwrapExecError(err)
+	if execErr == nil {
+		return false
+	}
+	switch e := execErr.Err.(type) {
+	case *LimitError:
+		return false
+	case *exec.ExitError:
+		if crashed(e.ProcessState) {
+			return true
+		}
+	}
+	if execErr.Err == context.Canceled || execErr.Err == context.DeadlineExceeded {
+		return false
+	}
+	return decodesCleanly(source)
+}
+
+func unwrapExecError(err error) *ExecError {
+	switch e := err.(type) {
+	case *OptimizerError:
+		return unwrapExecError(e.Err)
+	case *ToolError:
+		return unwrapExecError(e.Err)
+	case *ExecError:
+		return e
+	}
+	return nil
+}
+
+func decodesCleanly(source *ImageDescription) bool {
+	input, err := source.Open()
+	if err != nil {
+		return false
+	}
+	defer input.Close()
+	_, _, err = image.Decode(bufio.NewReader(input))
+	return err == nil
+}
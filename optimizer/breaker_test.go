@@ -0,0 +1,101 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// stubOptimizer fails with err when set.
+type stubOptimizer struct {
+	err  error
+	runs int
+}
+
+func (o *stubOptimizer) CanOptimize(mimeType string, acceptedTypes []string) bool {
+	return true
+}
+
+func (o *stubOptimizer) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	o.runs++
+	if o.err != nil {
+		return nil, o.err
+	}
+	return source, nil
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	valid := describeData("original", buf.Bytes(), "image/png")
+	truncated := describeData("original", buf.Bytes()[:buf.Len()/2], "image/png")
+	exitFailure := &ToolError{Tool: "cwebp", Err: &ExecError{Tool: "cwebp", Err: errors.New("exit status 1")}}
+
+	opt := &stubOptimizer{}
+	breaker := &CircuitBreaker{
+		Name:          "test-breaker",
+		Optimizer:     opt,
+		Threshold:     2,
+		ProbeInterval: 20 * time.Millisecond,
+	}
+	run := func(source *ImageDescription, err error) error {
+		opt.err = err
+		_, err = breaker.Optimize(context.Background(), source, 1)
+		return err
+	}
+
+	steps := []struct {
+		name   string
+		source *ImageDescription
+		err    error
+		sleep  time.Duration
+		open   bool
+		// The probe is not due yet.
+		skipped bool
+	}{
+		{name: "decode error", source: valid, err: &DecodeError{Err: errors.New("bad")}},
+		{name: "failure on a truncated source", source: truncated, err: exitFailure},
+		{name: "failure on a truncated source", source: truncated, err: exitFailure},
+		{name: "cpu limit", source: valid, err: &ExecError{Tool: "cwebp", Err: &LimitError{Limit: "cpu time"}}},
+		{name: "timeout", source: valid, err: &TimeoutError{}},
+		{name: "missing tool", source: valid, err: &ToolMissingError{Tool: "cwebp"}},
+		{name: "failure on a valid source", source: valid, err: exitFailure, open: true, skipped: true},
+		{name: "failed probe", source: valid, err: exitFailure, sleep: 30 * time.Millisecond, open: true, skipped: true},
+		// Input errors do not delay the next probe.
+		{name: "probe with an input error", source: truncated, err: exitFailure, sleep: 30 * time.Millisecond, open: true},
+		{name: "recovery", source: valid, open: false},
+		{name: "failure after recovery", source: valid, err: exitFailure},
+	}
+	for _, step := range steps {
+		time.Sleep(step.sleep)
+		if !breaker.CanOptimize("image/png", nil) {
+			t.Fatalf("%s: optimizer skipped", step.name)
+		}
+		runs := opt.runs
+		if err := run(step.source, step.err); err != step.err {
+			t.Fatalf("%s: got %v, want %v", step.name, err, step.err)
+		}
+		if opt.runs != runs+1 {
+			t.Fatalf("%s: optimizer not run", step.name)
+		}
+		breaker.mu.Lock()
+		open := breaker.open
+		breaker.mu.Unlock()
+		if open != step.open {
+			t.Fatalf("%s: got open %t, want %t", step.name, open, step.open)
+		}
+		if skipped := !breaker.CanOptimize("image/png", nil); skipped != step.skipped {
+			t.Fatalf("%s: got skipped %t, want %t", step.name, skipped, step.skipped)
+		}
+		if step.skipped {
+			if _, ok := run(step.source, nil).(*CircuitOpenError); !ok {
+				t.Fatalf("%s: open circuit let a run through", step.name)
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+// ToolSpec describes how to probe an external tool.
+type ToolSpec struct {
+	Name        string
+	VersionArgs []string
+	HelpArgs    []string
+	// Flags whose support is checked in the help output.
+	Flags []string
+}
+
+var DefaultToolSpecs = []ToolSpec{
+	{
+		Name:        "cwebp",
+		VersionArgs: []string{"-version"},
+		HelpArgs:    []string{"-longhelp"},
+		Flags:       []string{"-q", "-o", "-lossless", "-alpha_q"},
+	},
+	{
+		Name:        "cjpeg",
+		VersionArgs: []string{"-version"},
+		HelpArgs:    []string{"-help"},
+		Flags:       []string{"-quality", "-optimize", "-sample", "-quant-table", "-progressive", "-baseline"},
+	},
+	{
+		Name:        "jpegtran",
+		VersionArgs: []string{"-version"},
+		HelpArgs:    []string{"-help"},
+		Flags:       []string{"-copy", "-optimize"},
+	},
+	{
+		Name:        "optipng",
+		VersionArgs: []string{"-version"},
+		HelpArgs:    []string{"-help"},
+		Flags:       []string{"-out", "-strip"},
+	},
+	{
+		Name:        "heif-convert",
+		VersionArgs: []string{"--version"},
+		HelpArgs:    []string{"--help"},
+	},
+}
+
+const probeTimeout = 5 * time.Second
+
+type ToolCapability struct {
+	Name      string   `json:"name"`
+	Path      string   `json:"path,omitempty"`
+	Version   string   `json:"version,omitempty"`
+	Flags     []string `json:"flags"`
+	Available bool     `json:"available"`
+	Error     string   `json:"error,omitempty"`
+}
+
+const (
+	StatusEnabled  = "enabled"
+	StatusFallback = "fallback"
+	StatusDisabled = "disabled"
+)
+
+type OptimizerStatus struct {
+	Name   Name     `json:"name"`
+	Tools  []string `json:"tools"`
+	Status string   `json:"status"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+type Capabilities struct {
+	Tools      map[string]*ToolCapability `json:"tools"`
+	Optimizers []OptimizerStatus          `json:"optimizers"`
+}
+
+// ProbeCapabilities resolves the tools in PATH and records their versions and
+// supported flags.
+func ProbeCapabilities(ctx context.Context, executor Executor, specs []ToolSpec) *Capabilities {
+	caps := &Capabilities{
+		Tools:      make(map[string]*ToolCapability, len(specs)),
+		Optimizers: []OptimizerStatus{},
+	}
+	for _, spec := range specs {
+		caps.Tools[spec.Name] = probeTool(ctx, getExecutor(executor), spec)
+	}
+	return caps
+}
+
+func probeTool(ctx context.Context, executor Executor, spec ToolSpec) *ToolCapability {
+	tool := &ToolCapability{
+		Name:  spec.Name,
+		Flags: []string{},
+	}
+
+	toolPath, err := executor.LookPath(spec.Name)
+	if err != nil {
+		tool.Error = err.Error()
+		return tool
+	}
+	tool.Path = toolPath
+	tool.Available = true
+
+	if len(spec.VersionArgs) > 0 {
+		tool.Version = firstLine(probeOutput(ctx, executor, toolPath, spec.VersionArgs))
+	}
+	if len(spec.Flags) > 0 {
+		help := probeOutput(ctx, executor, toolPath, spec.HelpArgs)
+		for _, flag := range spec.Flags {
+			if hasFlag(help, flag) {
+				tool.Flags = append(tool.Flags, flag)
+			}
+		}
+	}
+	return tool
+}
+
+// probeOutput returns the combined output of the command. Many tools exit with
+// an error after printing their usage so the exit status is ignored.
+func probeOutput(ctx context.Context, executor Executor, toolPath string, args []string) string {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	executor.Run(ctx, &Command{
+		Name:   toolPath,
+		Args:   args,
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	return stdout.String() + stderr.String()
+}
+
+func firstLine(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
+func hasFlag(help, flag string) bool {
+	for i := strings.Index(help, flag); i >= 0; {
+		end := i + len(flag)
+		if end == len(help) || !isFlagChar(help[end]) {
+			return true
+		}
+		next := strings.Index(help[end:], flag)
+		if next < 0 {
+			break
+		}
+		i = end + next
+	}
+	return false
+}
+
+func isFlagChar(c byte) bool {
+	return c == '-' || c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// missing returns the reason the tools cannot be used or an empty string if
+// all tools and flags are supported.
+func (c *Capabilities) missing(tools []string, flags map[string][]string) string {
+	for _, name := range tools {
+		tool, ok := c.Tools[name]
+		if !ok {
+			continue
+		}
+		if !tool.Available {
+			return "tool " + name + " not available"
+		}
+		for _, flag := range flags[name] {
+			if !contains(tool.Flags, flag) {
+				return "tool " + name + " does not support " + flag
+			}
+		}
+	}
+	return ""
+}
+
+// CheckOptimizers enables or disables the optimizers depending on the probed
+// capabilities and records their status.
+func CheckOptimizers(optimizers []ImageOptimizer, caps *Capabilities) []OptimizerStatus {
+	statuses := make([]OptimizerStatus, 0, len(optimizers))
+	for _, opt := range optimizers {
+		if fallbackOptimizer, ok := opt.(*FallbackOptimizer); ok {
+			statuses = append(statuses, fallbackOptimizer.Resolve(caps))
+		}
+	}
+	caps.Optimizers = statuses
+	return statuses
+}
+
+// CheckTranscoders returns the transcoders whose tools are available.
+func CheckTranscoders(transcoders []Transcoder, caps *Capabilities) []Transcoder {
+	available := make([]Transcoder, 0, len(transcoders))
+	for _, transcoder := range transcoders {
+		if toolTranscoder, ok := transcoder.(ToolTranscoder); ok {
+			if reason := caps.missing(toolTranscoder.Tools(), nil); reason != "" {
+				log.Printf("Transcoder disabled: %s", reason)
+				continue
+			}
+		}
+		available = append(available, transcoder)
+	}
+	return available
+}
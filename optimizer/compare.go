@@ -0,0 +1,116 @@
+package optimizer
+
+import (
+	"bufio"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/disintegration/gift"
+	_ "golang.org/x/image/webp"
+)
+
+// decodeImage decodes the image in any of the registered formats, which
+// include png, jpeg, webp, bmp and tiff.
+func decodeImage(imageDesc *ImageDescription) (image.Image, error) {
+	file, err := imageDesc.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(bufio.NewReader(file))
+	if err != nil {
+		return nil, &DecodeError{Err: err}
+	}
+	return img, nil
+}
+
+// Comparison measures the similarity of optimized images to the original
+// source image, so the scores of all encoders are comparable. The source is
+// decoded and prepared once and reused for all images compared during a
+// quality search.
+type Comparison struct {
+	dpr       float64
+	reference MetricReference
+	// Hash of the pixels of the source, only computed when asked for.
+	sourceHash string
+}
+
+// newComparison prepares the source for comparisons with the metric at the
+// size in CSS pixels for the device pixel ratio. With a hash the pixels of the
+// source are hashed, unless another optimizer of the task already did, before
+// the decoded source is dropped.
+func newComparison(source *ImageDescription, dpr float64, metric Metric, hash *sourceHash) (*Comparison, error) {
+	img, err := decodeImage(source)
+	if err != nil {
+		return nil, err
+	}
+
+	comparison := &Comparison{
+		dpr: dpr,
+	}
+	if hash != nil {
+		comparison.sourceHash = hash.get(img)
+	}
+	img = scaleToCssPixels(img, dpr)
+	comparison.reference = metric.Prepare(img)
+	return comparison, nil
+}
+
+// SourceHash returns the hash of the pixels of the source image, empty when
+// the comparison was prepared without it.
+func (c *Comparison) SourceHash() string {
+	return c.sourceHash
+}
+
+func (c *Comparison) Compare(imageDesc *ImageDescription) (float64, error) {
+	img, err := decodeImage(imageDesc)
+	if err != nil {
+		return 0, err
+	}
+	img = scaleToCssPixels(img, c.dpr)
+	return c.reference.Score(img), nil
+}
+
+// scaleToCssPixels resizes the image displayed at the device pixel ratio to
+// the size perceived in CSS pixels. Images displayed at ratios up to 1 are
+// not resized.
+func scaleToCssPixels(img image.Image, dpr float64) image.Image {
+	if dpr <= 1 {
+		return img
+	}
+	width := int(math.Floor(float64(img.Bounds().Dx())/dpr + 0.5))
+	height := int(math.Floor(float64(img.Bounds().Dy())/dpr + 0.5))
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	g := gift.New(
+		gift.Resize(width, height, gift.LanczosResampling),
+	)
+	resized := image.NewRGBA(g.Bounds(img.Bounds()))
+	g.Draw(resized, img)
+	return resized
+}
+
+func extractAlphaChannel(img image.Image) *image.Alpha {
+	boundsMin := img.Bounds().Min
+	boundsMax := img.Bounds().Max
+
+	const devisor uint32 = uint32(^uint16(0)) / uint32(^uint8(0))
+
+	alpha := image.NewAlpha(img.Bounds())
+	for y := boundsMin.Y; y < boundsMax.Y; y++ {
+		for x := boundsMin.X; x < boundsMax.X; x++ {
+			_, _, _, a := img.At(x, y).RGBA()
+			alpha.SetAlpha(x, y, color.Alpha{
+				A: uint8(a / devisor),
+			})
+		}
+	}
+
+	return alpha
+}
@@ -1,183 +1,115 @@
 package optimizer
 
 import (
-	"bufio"
 	"context"
-	"errors"
 	"fmt"
-	"image"
-	"image/color"
-	"os"
-	"os/exec"
-	"path"
 	"strconv"
-
-	"github.com/arjantop/imageoptimizer/ssim"
-	"github.com/disintegration/gift"
-	"golang.org/x/image/webp"
 )
 
 var _ ImageOptimizer = &WebpLosslessOptimizer{}
 
 type WebpLosslessOptimizer struct {
-	Args []string
+	Args     []string
+	Executor Executor
 }
 
 func (o *WebpLosslessOptimizer) CanOptimize(mimeType string, acceptedTypes []string) bool {
 	return mimeType == "image/png" && isFiletypeAccepted(acceptedTypes, []string{"image/webp"})
 }
 
-func (o *WebpLosslessOptimizer) Optimize(ctx context.Context, sourcePath string, hidpi bool) (*ImageDescription, error) {
-	outputPath := tempFilename(os.TempDir(), path.Base(sourcePath))
-	args := []string{sourcePath, "-o", outputPath, "-lossless"}
-	err := exec.CommandContext(ctx, "cwebp", append(args, o.Args...)...).Run()
+func (o *WebpLosslessOptimizer) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	sourcePath, cleanup, err := source.File(ctx)
 	if err != nil {
-		return nil, errors.New("transforming file with cwebp-lossless: " + err.Error())
+		return nil, err
 	}
+	defer cleanup()
 
-	fileStat, err := os.Stat(outputPath)
+	args := []string{sourcePath, "-o", "-", "-lossless"}
+	output, err := runPiped(ctx, o.Executor, nil, "cwebp", append(args, o.Args...)...)
 	if err != nil {
-		return nil, err
+		return nil, &ToolError{Tool: "cwebp-lossless", Err: err}
 	}
 
-	return &ImageDescription{
-		Optimizer: Name("cwebp-lossless"),
-		Path:      outputPath,
-		MimeType:  "image/webp",
-		Size:      fileStat.Size(),
-	}, nil
+	return describeData(Name("cwebp-lossless"), output, "image/webp"), nil
 }
 
+var _ SourcePreparer = &webpQualityOptimizer{}
+
 type webpQualityOptimizer struct {
 	optimizerType string
+	executor      Executor
 }
 
-func (o *webpQualityOptimizer) OptimizePrecheck(ctx context.Context, sourcePath string) (bool, error) {
+func (o *webpQualityOptimizer) OptimizePrecheck(ctx context.Context, source *ImageDescription) (bool, error) {
 	return true, nil
 }
 
-func (o *webpQualityOptimizer) OptimizeQuality(ctx context.Context, sourcePath string, quality int) (*ImageDescription, error) {
-	outputPath := tempFilename(os.TempDir(), path.Base(sourcePath))
-	cmd := exec.CommandContext(ctx, "cwebp", "-q", strconv.Itoa(quality), "-alpha_q", "100", "-o", outputPath, sourcePath)
-
-	outputFile, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return nil, err
-	}
-	defer outputFile.Close()
-	bufWriter := bufio.NewWriter(outputFile)
-	cmd.Stdout = bufWriter
-
-	err = cmd.Run()
-	if err != nil {
-		return nil, errors.New("transforming file with cwebp: " + err.Error())
-	}
-
-	err = bufWriter.Flush()
-	if err != nil {
-		return nil, err
-	}
-
-	fileStat, err := os.Stat(outputPath)
-	if err != nil {
-		return nil, err
-	}
-
-	return &ImageDescription{
-		Optimizer: Name(fmt.Sprintf("cwebp-lossy[%s]", o.optimizerType)),
-		Path:      outputPath,
-		MimeType:  "image/webp",
-		Size:      fileStat.Size(),
-	}, nil
+func (o *webpQualityOptimizer) MaxQuality(source *ImageDescription) (int, bool) {
+	return jpegSourceQuality(o.optimizerType, source)
 }
 
-func (o *webpQualityOptimizer) CompareImages(ctx context.Context, sourcePath string, imageDesc *ImageDescription, hidpi bool) (float64, error) {
-	converted, err := o.OptimizeQuality(ctx, sourcePath, 100)
-	if err != nil {
-		return 0, err
+// PrepareSource writes sources held in memory to the workspace once, instead
+// of once for every quality tried.
+func (o *webpQualityOptimizer) PrepareSource(ctx context.Context, source *ImageDescription) (*ImageDescription, func(), error) {
+	if source.Data == nil {
+		return source, func() {}, nil
 	}
-
-	file1, err := os.Open(converted.Path)
+	sourcePath, cleanup, err := source.File(ctx)
 	if err != nil {
-		return 0, err
+		return nil, nil, err
 	}
-	defer file1.Close()
-	img1, err := webp.Decode(file1)
-	if err != nil {
-		return 0, err
+	prepared := &ImageDescription{
+		Optimizer: source.Optimizer,
+		Path:      sourcePath,
+		MimeType:  source.MimeType,
+		Size:      source.Size,
 	}
+	return prepared, cleanup, nil
+}
 
-	file2, err := os.Open(imageDesc.Path)
+func (o *webpQualityOptimizer) OptimizeQuality(ctx context.Context, source *ImageDescription, quality int) (*ImageDescription, error) {
+	sourcePath, cleanup, err := source.File(ctx)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	defer file2.Close()
+	defer cleanup()
 
-	img2, err := webp.Decode(file2)
+	output, err := runPiped(ctx, o.executor, nil, "cwebp", "-q", strconv.Itoa(quality), "-alpha_q", "100", "-o", "-", sourcePath)
 	if err != nil {
-		return 0, err
-	}
-
-	if hidpi {
-		g := gift.New(
-			gift.Resize(img1.Bounds().Dx()/2, 0, gift.LanczosResampling),
-		)
-
-		resized1 := image.NewRGBA(g.Bounds(img1.Bounds()))
-		g.Draw(resized1, img1)
-		img1 = resized1
-		resized2 := image.NewRGBA(g.Bounds(img2.Bounds()))
-		g.Draw(resized2, img2)
-		img2 = resized2
-	}
-
-	return ssim.SsimWithAlpha(convertToGrayscale(img1), convertToGrayscale(img2), extractAlphaChannel(img1)), nil
-	//return ssim.Ssim(convertToGrayscale(img1), convertToGrayscale(img2)), nil
-}
-
-func extractAlphaChannel(img image.Image) *image.Alpha {
-	boundsMin := img.Bounds().Min
-	boundsMax := img.Bounds().Max
-
-	const devisor uint32 = uint32(^uint16(0)) / uint32(^uint8(0))
-
-	alpha := image.NewAlpha(img.Bounds())
-	for y := boundsMin.Y; y < boundsMax.Y; y++ {
-		for x := boundsMin.X; x < boundsMax.X; x++ {
-			_, _, _, a := img.At(x, y).RGBA()
-			alpha.SetAlpha(x, y, color.Alpha{
-				A: uint8(a / devisor),
-			})
-		}
+		return nil, &ToolError{Tool: "cwebp", Err: err}
 	}
 
-	return alpha
+	return describeData(Name(fmt.Sprintf("cwebp-lossy[%s]", o.optimizerType)), output, "image/webp"), nil
 }
 
 func (o *webpQualityOptimizer) CanOptimize(mimeType string, acceptedTypes []string) bool {
 	return mimeType == o.optimizerType && isFiletypeAccepted(acceptedTypes, []string{"image/webp"})
 }
 
-func (o *webpQualityOptimizer) Optimize(ctx context.Context, sourcePath string, hidpi bool) (*ImageDescription, error) {
-	return o.OptimizeQuality(ctx, sourcePath, 100)
+func (o *webpQualityOptimizer) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	return o.OptimizeQuality(ctx, source, 100)
 }
 
-func NewWebpLossyPngOptimizer(minSsim float64) ImageOptimizer {
+// NewWebpLossyPngOptimizer returns an optimizer encoding png images to lossy
+// webp with cwebp run by the executor, DefaultExecutor when nil.
+func NewWebpLossyPngOptimizer(metric Metric, executor Executor) ImageOptimizer {
 	opt := &webpQualityOptimizer{
 		optimizerType: "image/png",
+		executor:      executor,
 	}
 	return &AutomaticOptimizer{
 		Optimizer: opt,
-		MinSsim:   minSsim,
+		Metric:    metric,
 	}
 }
 
-func NewWebpLossyJpegOptimizer(minSsim float64) ImageOptimizer {
+func NewWebpLossyJpegOptimizer(metric Metric, executor Executor) ImageOptimizer {
 	opt := &webpQualityOptimizer{
 		optimizerType: "image/jpeg",
+		executor:      executor,
 	}
 	return &AutomaticOptimizer{
 		Optimizer: opt,
-		MinSsim:   minSsim,
+		Metric:    metric,
 	}
 }
@@ -0,0 +1,66 @@
+package optimizer
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+)
+
+// MediaType returns the content type without any parameters.
+func MediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return contentType
+	}
+	return mediaType
+}
+
+// detectContentType sniffs the content type from the header of the file.
+// The declared type is the content type reported by the origin server and
+// is used to disambiguate types that cannot be sniffed reliably.
+func detectContentType(header []byte, declaredType string) string {
+	if imageType := detectImageType(header); imageType != "" {
+		return imageType
+	}
+	detectedType := MediaType(http.DetectContentType(header))
+	if (detectedType == "text/xml" || detectedType == "text/plain") && isSvg(header, MediaType(declaredType)) {
+		return "image/svg+xml"
+	}
+	return detectedType
+}
+
+func isSvg(header []byte, declaredType string) bool {
+	return declaredType == "image/svg+xml" || bytes.Contains(header, []byte("<svg"))
+}
+
+var tiffSignatures = [][]byte{
+	[]byte("II*\x00"),
+	[]byte("MM\x00*"),
+}
+
+// ISO base media file format brands used by HEIF images.
+var heifBrands = map[string]string{
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"hevc": "image/heic-sequence",
+	"hevx": "image/heic-sequence",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif-sequence",
+}
+
+// detectImageType recognizes image formats not known to http.DetectContentType.
+func detectImageType(header []byte) string {
+	for _, signature := range tiffSignatures {
+		if bytes.HasPrefix(header, signature) {
+			return "image/tiff"
+		}
+	}
+	if len(header) >= 12 && string(header[4:8]) == "ftyp" {
+		if mimeType, ok := heifBrands[string(header[8:12])]; ok {
+			return mimeType
+		}
+	}
+	return ""
+}
@@ -0,0 +1,106 @@
+package optimizer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Encodings supported by EncodeContent in order of preference.
+var supportedEncodings = []string{"br", "gzip"}
+
+var compressibleTypes = []string{"image/svg+xml"}
+
+// Encoding runs on the request goroutine, so a moderate brotli level is used
+// and larger images are sent unencoded.
+const brotliLevel = 5
+
+// Maximum size of images encoded by EncodeContent.
+var MaxEncodedSize int64 = 8 << 20
+
+func IsCompressible(mimeType string) bool {
+	return contains(compressibleTypes, mimeType)
+}
+
+// NegotiateEncoding returns the preferred content encoding accepted by the
+// client or an empty string if the content should be sent unencoded.
+func NegotiateEncoding(acceptEncoding string) string {
+	accepted := make([]string, 0, 2)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(params[0]))
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			accepted = append(accepted, encoding)
+		}
+	}
+	for _, encoding := range supportedEncodings {
+		if contains(accepted, encoding) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// EncodeContent compresses the image with the given content encoding.
+func EncodeContent(imageDesc *ImageDescription, encoding string) (*ImageDescription, error) {
+	if !contains(supportedEncodings, encoding) || imageDesc.Size > MaxEncodedSize {
+		return imageDesc, nil
+	}
+
+	input, err := imageDesc.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	output := &bytes.Buffer{}
+	var encoder io.WriteCloser
+	if encoding == "br" {
+		encoder = brotli.NewWriterLevel(output, brotliLevel)
+	} else {
+		encoder, err = gzip.NewWriterLevel(output, gzip.BestCompression)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = io.Copy(encoder, input)
+	if err != nil {
+		return nil, err
+	}
+	err = encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := describeData(imageDesc.Optimizer, output.Bytes(), imageDesc.MimeType)
+	encoded.ContentEncoding = encoding
+	return encoded, nil
+}
+
+// DecodeContent returns a reader decoding the content encoded by the origin
+// server.
+func DecodeContent(r io.Reader, encoding string) (io.Reader, error) {
+	switch strings.ToLower(encoding) {
+	case "br":
+		return brotli.NewReader(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	default:
+		return r, nil
+	}
+}
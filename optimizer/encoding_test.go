@@ -0,0 +1,45 @@
+package optimizer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncodeContent(t *testing.T) {
+	data := bytes.Repeat([]byte(`<path d="M0 0h10v10H0z"/>`), 100)
+	source := describeData("svg-minify", data, "image/svg+xml")
+	for _, encoding := range []string{"br", "gzip"} {
+		encoded, err := EncodeContent(source, encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded.ContentEncoding != encoding || encoded.Size >= source.Size {
+			t.Errorf("%s: got encoding %q and size %d", encoding, encoded.ContentEncoding, encoded.Size)
+			continue
+		}
+		decoder, err := DecodeContent(bytes.NewReader(encoded.Data), encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := ioutil.ReadAll(decoder)
+		if err != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("%s: decoded content differs (%v)", encoding, err)
+		}
+	}
+}
+
+func TestEncodeContentSizeCap(t *testing.T) {
+	maxEncodedSize := MaxEncodedSize
+	MaxEncodedSize = 100
+	defer func() { MaxEncodedSize = maxEncodedSize }()
+
+	source := describeData("svg-minify", bytes.Repeat([]byte("a"), 101), "image/svg+xml")
+	encoded, err := EncodeContent(source, "br")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded != source {
+		t.Errorf("image larger than the cap encoded with %q", encoded.ContentEncoding)
+	}
+}
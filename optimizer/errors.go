@@ -0,0 +1,137 @@
+package optimizer
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+)
+
+// Number of optimizer failures by the kind of the failure.
+var optimizerFailures = expvar.NewMap("optimizer_failures")
+
+// UnsupportedInputError is returned when none of the optimizers can optimize
+// the source image for the client.
+type UnsupportedInputError struct {
+	MimeType string
+}
+
+func (e *UnsupportedInputError) Error() string {
+	return "no optimizer for " + e.MimeType
+}
+
+// ToolMissingError is returned when an external tool cannot be found.
+type ToolMissingError struct {
+	Tool string
+}
+
+func (e *ToolMissingError) Error() string {
+	return e.Tool + ": tool not found"
+}
+
+// ToolError is returned when transforming a file with an external tool fails,
+// the error of the executor is kept so it can be classified.
+type ToolError struct {
+	Tool string
+	Err  error
+}
+
+func (e *ToolError) Error() string {
+	return "transforming file with " + e.Tool + ": " + e.Err.Error()
+}
+
+// TimeoutError is returned when an optimizer does not finish in time.
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return "timed out: " + e.Err.Error()
+}
+
+// DecodeError is returned when an image cannot be decoded.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return "decoding image: " + e.Err.Error()
+}
+
+// ComparisonError is returned when an optimized image cannot be compared to
+// the source image.
+type ComparisonError struct {
+	Err error
+}
+
+func (e *ComparisonError) Error() string {
+	return "comparing images: " + e.Err.Error()
+}
+
+// OptimizerError is a failure of a single optimizer of a task.
+type OptimizerError struct {
+	Optimizer string
+	Err       error
+}
+
+func (e *OptimizerError) Error() string {
+	return e.Optimizer + ": " + e.Err.Error()
+}
+
+// ErrorKind classifies the error as one of unsupported_input, input_rejected,
+// queue_full, tool_missing, tool_failure, timeout, decode, comparison,
+// circuit_open or unknown.
+func ErrorKind(err error) string {
+	switch e := err.(type) {
+	case *OptimizerError:
+		return ErrorKind(e.Err)
+	case *ToolError:
+		return ErrorKind(e.Err)
+	case *UnsupportedInputError:
+		return "unsupported_input"
+	case *InputRejectedError:
+		return "input_rejected"
+	case *ToolMissingError:
+		return "tool_missing"
+	case *ExecError:
+		if limitErr, ok := e.Err.(*LimitError); ok && limitErr.Limit == "wall clock" {
+			return "timeout"
+		}
+		return "tool_failure"
+	case *TimeoutError:
+		return "timeout"
+	case *DecodeError:
+		return "decode"
+	case *ComparisonError:
+		return "comparison"
+	case *CircuitOpenError:
+		return "circuit_open"
+	}
+	switch err {
+	case ErrQueueFull:
+		return "queue_full"
+	case context.DeadlineExceeded:
+		return "timeout"
+	}
+	return "unknown"
+}
+
+func optimizerName(o ImageOptimizer) string {
+	switch o := o.(type) {
+	case *FallbackOptimizer:
+		return string(o.Name)
+	case *CircuitBreaker:
+		return o.name()
+	case *AutomaticOptimizer:
+		return optimizerName(o.Optimizer)
+	case *webpQualityOptimizer:
+		return "cwebp-lossy[" + o.optimizerType + "]"
+	case *nativeJpegQualityOptimizer:
+		return "jpeg-lossy[" + o.optimizerType + "]"
+	case *mozjpegQualityOptimizer:
+		if settings := o.settings.String(); settings != "" {
+			return "mozjpeg-lossy[" + o.optimizerType + ";" + settings + "]"
+		}
+		return "mozjpeg-lossy[" + o.optimizerType + "]"
+	}
+	return fmt.Sprintf("%T", o)
+}
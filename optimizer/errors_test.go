@@ -0,0 +1,47 @@
+package optimizer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testWorkspace(t *testing.T) (context.Context, func()) {
+	dir, err := ioutil.TempDir("", "imageoptimizer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	workspace, err := NewWorkspace(dir, 1<<20)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return WithWorkspace(context.Background(), workspace), func() {
+		workspace.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestToolErrorKind(t *testing.T) {
+	ctx, cleanup := testWorkspace(t)
+	defer cleanup()
+
+	executor := NewFakeExecutor()
+	source := describeData("original", []byte("png"), "image/png")
+	optimizer := &WebpLosslessOptimizer{Executor: executor}
+
+	_, err := optimizer.Optimize(ctx, source, 1)
+	if kind := ErrorKind(err); kind != "tool_missing" {
+		t.Errorf("missing tool: got kind %s (%v)", kind, err)
+	}
+
+	executor.Handle("cwebp", FakeFailure("cannot read input"))
+	_, err = optimizer.Optimize(ctx, source, 1)
+	if kind := ErrorKind(err); kind != "tool_failure" {
+		t.Errorf("failing tool: got kind %s (%v)", kind, err)
+	}
+	if kind := ErrorKind(&OptimizerError{Optimizer: "cwebp-lossless", Err: err}); kind != "tool_failure" {
+		t.Errorf("optimizer error: got kind %s", kind)
+	}
+}
@@ -0,0 +1,208 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Command describes an invocation of an external tool.
+type Command struct {
+	Name   string
+	Args   []string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Executor runs the external tools used by the optimizers.
+type Executor interface {
+	LookPath(name string) (string, error)
+	Run(ctx context.Context, cmd *Command) error
+}
+
+var DefaultExecutor Executor = &OsExecutor{}
+
+func getExecutor(executor Executor) Executor {
+	if executor == nil {
+		return DefaultExecutor
+	}
+	return executor
+}
+
+// ExecError is returned when an external tool fails.
+type ExecError struct {
+	Tool   string
+	Err    error
+	Stderr string
+}
+
+func (e *ExecError) Error() string {
+	msg := e.Tool + ": " + e.Err.Error()
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+// Maximum number of bytes of stderr included in errors.
+const maxStderrSize = 4096
+
+var _ Executor = &OsExecutor{}
+
+// OsExecutor runs the tools as local processes with the configured limits.
+// The limits are applied right after a process is started, so it runs without
+// them for the short time until then.
+type OsExecutor struct {
+	// Limits applied to tools without an entry in ToolLimits.
+	DefaultLimits ToolLimits
+	ToolLimits    map[string]ToolLimits
+
+	mu         sync.Mutex
+	semaphores map[string]chan struct{}
+}
+
+func (e *OsExecutor) LookPath(name string) (string, error) {
+	return exec.LookPath(name)
+}
+
+func (e *OsExecutor) limits(tool string) ToolLimits {
+	if limits, ok := e.ToolLimits[tool]; ok {
+		return limits
+	}
+	return e.DefaultLimits
+}
+
+// acquire waits until another process of the tool is allowed to run and
+// returns the function releasing it.
+func (e *OsExecutor) acquire(ctx context.Context, tool string, concurrency int) (func(), error) {
+	if concurrency <= 0 {
+		return func() {}, nil
+	}
+
+	e.mu.Lock()
+	if e.semaphores == nil {
+		e.semaphores = make(map[string]chan struct{})
+	}
+	semaphore, ok := e.semaphores[tool]
+	if !ok {
+		semaphore = make(chan struct{}, concurrency)
+		e.semaphores[tool] = semaphore
+	}
+	e.mu.Unlock()
+
+	select {
+	case semaphore <- struct{}{}:
+		return func() { <-semaphore }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (e *OsExecutor) Run(ctx context.Context, cmd *Command) error {
+	tool := filepath.Base(cmd.Name)
+	limits := e.limits(tool)
+
+	release, err := e.acquire(ctx, tool, limits.Concurrency)
+	if err != nil {
+		return &ExecError{
+			Tool: cmd.Name,
+			Err:  err,
+		}
+	}
+	defer release()
+
+	runCtx := ctx
+	if limits.WallClock > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, limits.WallClock)
+		defer cancel()
+	}
+
+	stderr := &limitedBuffer{limit: maxStderrSize}
+	c := exec.CommandContext(runCtx, cmd.Name, cmd.Args...)
+	c.Stdin = cmd.Stdin
+	c.Stdout = cmd.Stdout
+	c.Stderr = stderr
+	if cmd.Stderr != nil {
+		c.Stderr = io.MultiWriter(stderr, cmd.Stderr)
+	}
+
+	err = c.Start()
+	if execErr, ok := err.(*exec.Error); ok && execErr.Err == exec.ErrNotFound {
+		return &ToolMissingError{Tool: cmd.Name}
+	}
+	if err == nil {
+		limitErr := applyLimits(c.Process.Pid, limits)
+		if limitErr != nil {
+			log.Printf("Could not apply limits to %s err=%s", tool, limitErr)
+		}
+		err = c.Wait()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			// Killed because the run was cancelled, not because of a limit.
+			err = ctx.Err()
+		} else if runCtx.Err() == context.DeadlineExceeded {
+			err = &LimitError{
+				Limit: "wall clock",
+				Value: limits.WallClock.String(),
+			}
+		} else if c.ProcessState != nil {
+			if limitErr := exceededLimit(c.ProcessState, limits, stderr.String()); limitErr != nil {
+				err = limitErr
+			}
+		}
+		return &ExecError{
+			Tool:   cmd.Name,
+			Err:    err,
+			Stderr: strings.TrimSpace(stderr.String()),
+		}
+	}
+	return nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the rest.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := b.limit - b.Len(); remaining > 0 {
+		if len(p) > remaining {
+			b.Buffer.Write(p[:remaining])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// runPiped runs the tool with the input as standard input and returns its
+// standard output.
+func runPiped(ctx context.Context, executor Executor, input io.Reader, name string, args ...string) ([]byte, error) {
+	var output bytes.Buffer
+	err := getExecutor(executor).Run(ctx, &Command{
+		Name:   name,
+		Args:   args,
+		Stdin:  input,
+		Stdout: &output,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
+
+func run(ctx context.Context, executor Executor, name string, args ...string) error {
+	return getExecutor(executor).Run(ctx, &Command{
+		Name: name,
+		Args: args,
+	})
+}
@@ -0,0 +1,45 @@
+package optimizer
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestOsExecutorCancelled(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not available")
+	}
+	executor := &OsExecutor{
+		DefaultLimits: ToolLimits{CPUTime: time.Minute},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := executor.Run(ctx, &Command{Name: "sleep", Args: []string{"5"}})
+	execErr, ok := err.(*ExecError)
+	if !ok {
+		t.Fatalf("got %v, want an ExecError", err)
+	}
+	if _, ok := execErr.Err.(*LimitError); ok {
+		t.Errorf("cancelled run reported as exceeding a limit: %v", err)
+	}
+	if execErr.Err != context.DeadlineExceeded {
+		t.Errorf("got %v, want the error of the context", execErr.Err)
+	}
+}
+
+func TestOsExecutorWallClock(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not available")
+	}
+	executor := &OsExecutor{
+		DefaultLimits: ToolLimits{CPUTime: time.Minute, WallClock: 200 * time.Millisecond},
+	}
+
+	err := executor.Run(context.Background(), &Command{Name: "sleep", Args: []string{"5"}})
+	if kind := ErrorKind(err); kind != "timeout" {
+		t.Errorf("got kind %s (%v), want timeout", kind, err)
+	}
+}
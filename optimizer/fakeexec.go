@@ -0,0 +1,100 @@
+package optimizer
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"sync"
+)
+
+// FakeHandler simulates a run of an external tool.
+type FakeHandler func(ctx context.Context, cmd *Command) error
+
+var _ Executor = &FakeExecutor{}
+
+// FakeExecutor is a scriptable Executor for tests. Commands are dispatched to
+// the handler registered for the tool and recorded for later inspection.
+// Tools without a handler are reported as missing.
+type FakeExecutor struct {
+	mu       sync.Mutex
+	handlers map[string]FakeHandler
+	commands []Command
+}
+
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{
+		handlers: make(map[string]FakeHandler),
+	}
+}
+
+func (e *FakeExecutor) Handle(name string, handler FakeHandler) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.handlers[name] = handler
+}
+
+// Commands returns the commands run so far.
+func (e *FakeExecutor) Commands() []Command {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	commands := make([]Command, len(e.commands))
+	copy(commands, e.commands)
+	return commands
+}
+
+func (e *FakeExecutor) LookPath(name string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.handlers[name]; !ok {
+		return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+	}
+	return "/fake/bin/" + name, nil
+}
+
+func (e *FakeExecutor) Run(ctx context.Context, cmd *Command) error {
+	e.mu.Lock()
+	e.commands = append(e.commands, *cmd)
+	handler, ok := e.handlers[cmd.Name]
+	e.mu.Unlock()
+
+	if !ok {
+		return &ToolMissingError{Tool: cmd.Name}
+	}
+	return handler(ctx, cmd)
+}
+
+// FakeStdout returns a handler writing data to the standard output.
+func FakeStdout(data []byte) FakeHandler {
+	return func(ctx context.Context, cmd *Command) error {
+		if cmd.Stdout == nil {
+			return nil
+		}
+		_, err := cmd.Stdout.Write(data)
+		return err
+	}
+}
+
+// FakeOutputFile returns a handler writing data to the file named by the
+// argument following flag, e.g. -o for cwebp.
+func FakeOutputFile(flag string, data []byte) FakeHandler {
+	return func(ctx context.Context, cmd *Command) error {
+		for i, arg := range cmd.Args {
+			if arg == flag && i+1 < len(cmd.Args) {
+				return ioutil.WriteFile(cmd.Args[i+1], data, 0644)
+			}
+		}
+		return errors.New("fake: output flag " + flag + " not found")
+	}
+}
+
+// FakeFailure returns a handler failing with the given stderr output.
+func FakeFailure(stderr string) FakeHandler {
+	return func(ctx context.Context, cmd *Command) error {
+		return &ExecError{
+			Tool:   cmd.Name,
+			Err:    errors.New("exit status 1"),
+			Stderr: stderr,
+		}
+	}
+}
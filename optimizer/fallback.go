@@ -0,0 +1,87 @@
+package optimizer
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+)
+
+var _ ImageOptimizer = &FallbackOptimizer{}
+
+// FallbackOptimizer uses the optimizer when all of the external tools it
+// depends on can be found in PATH and the fallback otherwise. Without a
+// fallback the optimizer is disabled when a tool is missing.
+type FallbackOptimizer struct {
+	Name      Name
+	Optimizer ImageOptimizer
+	Fallback  ImageOptimizer
+	Tools     []string
+	Executor  Executor
+	// Flags the optimizer requires for each of the tools.
+	Flags map[string][]string
+
+	mu       sync.Mutex
+	resolved bool
+	chosen   ImageOptimizer
+}
+
+func (o *FallbackOptimizer) current() ImageOptimizer {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.resolved {
+		o.chosen = o.Optimizer
+		for _, tool := range o.Tools {
+			if _, err := getExecutor(o.Executor).LookPath(tool); err != nil {
+				log.Printf("Tool %s not found, using fallback optimizer err=%s", tool, err)
+				o.chosen = o.Fallback
+				break
+			}
+		}
+		o.resolved = true
+	}
+	return o.chosen
+}
+
+// Resolve chooses between the optimizer and the fallback using the probed
+// capabilities instead of looking up the tools on first use.
+func (o *FallbackOptimizer) Resolve(caps *Capabilities) OptimizerStatus {
+	status := OptimizerStatus{
+		Name:   o.Name,
+		Tools:  o.Tools,
+		Status: StatusEnabled,
+		Reason: caps.missing(o.Tools, o.Flags),
+	}
+
+	chosen := o.Optimizer
+	if status.Reason != "" {
+		chosen = o.Fallback
+		if chosen != nil {
+			status.Status = StatusFallback
+			log.Printf("Optimizer %s using fallback: %s", o.Name, status.Reason)
+		} else {
+			status.Status = StatusDisabled
+			log.Printf("Optimizer %s disabled: %s", o.Name, status.Reason)
+		}
+	}
+
+	o.mu.Lock()
+	o.chosen = chosen
+	o.resolved = true
+	o.mu.Unlock()
+
+	return status
+}
+
+func (o *FallbackOptimizer) CanOptimize(mimeType string, acceptedTypes []string) bool {
+	opt := o.current()
+	return opt != nil && opt.CanOptimize(mimeType, acceptedTypes)
+}
+
+func (o *FallbackOptimizer) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	opt := o.current()
+	if opt == nil {
+		return nil, &ToolMissingError{Tool: strings.Join(o.Tools, ", ")}
+	}
+	return opt.Optimize(ctx, source, dpr)
+}
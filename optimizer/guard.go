@@ -0,0 +1,82 @@
+package optimizer
+
+import (
+	"expvar"
+	"fmt"
+	"image"
+)
+
+// InputLimits guard against inputs that are too expensive to optimize, such
+// as decompression bombs. Zero values mean no limit.
+type InputLimits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64
+	MaxBytes  int64
+}
+
+// Number of rejected inputs by the reason of the rejection.
+var inputRejections = expvar.NewMap("input_rejections")
+
+// InputRejectedError is returned when the source image exceeds the limits.
+type InputRejectedError struct {
+	Reason string
+	Detail string
+}
+
+func (e *InputRejectedError) Error() string {
+	return "input rejected (" + e.Reason + "): " + e.Detail
+}
+
+func rejectInput(reason, format string, args ...interface{}) error {
+	inputRejections.Add(reason, 1)
+	return &InputRejectedError{
+		Reason: reason,
+		Detail: fmt.Sprintf(format, args...),
+	}
+}
+
+// CheckInputSize checks the size in bytes of the source before it is read.
+func CheckInputSize(size int64, limits InputLimits) error {
+	if limits.MaxBytes > 0 && size > limits.MaxBytes {
+		return rejectInput("bytes", "%d bytes exceeds %d", size, limits.MaxBytes)
+	}
+	return nil
+}
+
+// checkInput verifies the source against the limits using only the image
+// header. Formats without a registered decoder are only checked for size and
+// malformed headers are reported as a DecodeError.
+func checkInput(source *ImageDescription, limits InputLimits) error {
+	err := CheckInputSize(source.Size, limits)
+	if err != nil {
+		return err
+	}
+	if limits.MaxWidth <= 0 && limits.MaxHeight <= 0 && limits.MaxPixels <= 0 {
+		return nil
+	}
+
+	file, err := source.Open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err == image.ErrFormat {
+		return nil
+	} else if err != nil {
+		return &DecodeError{Err: err}
+	}
+
+	if limits.MaxWidth > 0 && config.Width > limits.MaxWidth {
+		return rejectInput("width", "width %d exceeds %d", config.Width, limits.MaxWidth)
+	}
+	if limits.MaxHeight > 0 && config.Height > limits.MaxHeight {
+		return rejectInput("height", "height %d exceeds %d", config.Height, limits.MaxHeight)
+	}
+	if pixels := int64(config.Width) * int64(config.Height); limits.MaxPixels > 0 && pixels > limits.MaxPixels {
+		return rejectInput("pixels", "%d pixels exceeds %d", pixels, limits.MaxPixels)
+	}
+	return nil
+}
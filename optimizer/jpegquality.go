@@ -0,0 +1,224 @@
+package optimizer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+// Luminance quantization table of the IJG libjpeg encoder at quality 50, in
+// the zigzag order of the DQT segment.
+var standardLuminanceTable = [64]int{
+	16, 11, 12, 14, 12, 10, 16, 14,
+	13, 14, 18, 17, 16, 19, 24, 40,
+	26, 24, 22, 22, 24, 49, 35, 37,
+	29, 40, 58, 51, 61, 60, 57, 51,
+	56, 55, 64, 72, 92, 78, 64, 68,
+	87, 69, 55, 56, 80, 109, 81, 87,
+	95, 98, 103, 104, 103, 62, 77, 113,
+	121, 112, 100, 120, 92, 101, 103, 99,
+}
+
+// EstimateJpegQuality estimates the IJG quality factor the jpeg image was
+// encoded with from its luminance quantization table.
+func EstimateJpegQuality(r io.Reader) (int, error) {
+	table, err := readLuminanceTable(bufio.NewReader(r))
+	if err != nil {
+		return 0, err
+	}
+
+	// Values clamped to 1 or 255 by the encoder do not tell the scale.
+	var sum, standardSum, ones int
+	for i, value := range table {
+		if value == 1 {
+			ones++
+		} else if value < 255 {
+			sum += value
+			standardSum += standardLuminanceTable[i]
+		}
+	}
+	if standardSum == 0 {
+		if ones > 0 {
+			return 100, nil
+		}
+		return 1, nil
+	}
+	// Inverse of the scaling of the standard table done by libjpeg.
+	scale := float64(sum) * 100 / float64(standardSum)
+	var quality float64
+	if scale <= 100 {
+		quality = (200 - scale) / 2
+	} else {
+		quality = 5000 / scale
+	}
+
+	estimate := int(quality + 0.5)
+	if estimate < 1 {
+		estimate = 1
+	} else if estimate > 100 {
+		estimate = 100
+	}
+
+	// The sums are rounded so a neighbouring quality may fit the table better.
+	residual := quantizationResidual(table, estimate)
+	for q := estimate - 2; q <= estimate+2; q++ {
+		if q < 1 || q > 100 || q == estimate {
+			continue
+		}
+		if r := quantizationResidual(table, q); r < residual {
+			estimate, residual = q, r
+		}
+	}
+	if residual > maxQuantizationResidual {
+		return 0, errors.New("quantization table is not a scaled standard table")
+	}
+	return estimate, nil
+}
+
+// Tables differing more from the scaled standard table were not produced by
+// IJG scaling, for example mozjpeg with -quant-table 3, and the quality
+// estimated from them is meaningless.
+const maxQuantizationResidual = 0.1
+
+// quantizationResidual returns the difference between the table and the
+// standard table scaled to the quality by libjpeg, relative to the latter.
+func quantizationResidual(table []int, quality int) float64 {
+	scale := 200 - 2*quality
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	// Baseline tables are clamped to 8 bits.
+	limit := 255
+	for _, value := range table {
+		if value > 255 {
+			limit = 32767
+		}
+	}
+
+	var diff, total int
+	for i, value := range table {
+		expected := (standardLuminanceTable[i]*scale + 50) / 100
+		if expected < 1 {
+			expected = 1
+		} else if expected > limit {
+			expected = limit
+		}
+		if value > expected {
+			diff += value - expected
+		} else {
+			diff += expected - value
+		}
+		total += expected
+	}
+	return float64(diff) / float64(total)
+}
+
+// jpegSourceQuality estimates the quality of jpeg sources.
+func jpegSourceQuality(sourceType string, source *ImageDescription) (int, bool) {
+	if sourceType != "image/jpeg" {
+		return 0, false
+	}
+	file, err := source.Open()
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+
+	quality, err := EstimateJpegQuality(file)
+	if err != nil {
+		log.Printf("Could not estimate jpeg quality err=%s", err)
+		return 0, false
+	}
+	return quality, true
+}
+
+// readLuminanceTable returns the quantization table with id 0 from the DQT
+// segments before the first scan.
+func readLuminanceTable(r *bufio.Reader) ([]int, error) {
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil {
+		return nil, err
+	}
+	if marker[0] != 0xff || marker[1] != 0xd8 {
+		return nil, errors.New("not a jpeg image")
+	}
+
+	for {
+		if _, err := io.ReadFull(r, marker[:]); err != nil {
+			return nil, err
+		}
+		if marker[0] != 0xff {
+			return nil, errors.New("invalid jpeg marker")
+		}
+		// Markers without a segment.
+		if marker[1] == 0xff || marker[1] == 0x01 || (marker[1] >= 0xd0 && marker[1] <= 0xd7) {
+			continue
+		}
+		if marker[1] == 0xda || marker[1] == 0xd9 {
+			return nil, errors.New("no luminance quantization table")
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, err
+		}
+		if length < 2 {
+			return nil, errors.New("invalid jpeg segment length")
+		}
+		segment := io.LimitReader(r, int64(length-2))
+
+		if marker[1] != 0xdb {
+			if _, err := io.Copy(ioutil.Discard, segment); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		table, err := readQuantizationTables(segment)
+		if err != nil {
+			return nil, err
+		}
+		if table != nil {
+			return table, nil
+		}
+	}
+}
+
+// readQuantizationTables reads the tables of a DQT segment and returns the one
+// with id 0 when present.
+func readQuantizationTables(segment io.Reader) ([]int, error) {
+	var luminance []int
+	for {
+		var info [1]byte
+		if _, err := io.ReadFull(segment, info[:]); err == io.EOF {
+			return luminance, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		precision := info[0] >> 4
+		id := info[0] & 0x0f
+		values := make([]byte, 64)
+		if precision == 1 {
+			values = make([]byte, 128)
+		}
+		if _, err := io.ReadFull(segment, values); err != nil {
+			return nil, err
+		}
+		if id != 0 {
+			continue
+		}
+
+		luminance = make([]int, 64)
+		for i := range luminance {
+			if precision == 1 {
+				luminance[i] = int(binary.BigEndian.Uint16(values[2*i:]))
+			} else {
+				luminance[i] = int(values[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package optimizer
+
+import (
+	"bufio"
+	"bytes"
+	"image/jpeg"
+	"reflect"
+	"testing"
+)
+
+// Natural order index of the coefficients in the zigzag order of DQT segments.
+var testZigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10, 17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34, 27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36, 29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46, 53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// Luminance table written by cjpeg -quality 75, in natural order.
+var testCjpegTable75 = [64]int{
+	8, 6, 5, 8, 12, 20, 26, 31,
+	6, 6, 7, 10, 13, 29, 30, 28,
+	7, 7, 8, 12, 20, 29, 35, 28,
+	7, 9, 11, 15, 26, 44, 40, 31,
+	9, 11, 19, 28, 34, 55, 52, 39,
+	12, 18, 28, 32, 41, 52, 57, 46,
+	25, 32, 39, 44, 52, 61, 60, 51,
+	36, 46, 48, 49, 56, 50, 52, 50,
+}
+
+// Luminance base table of mozjpeg -quant-table 3, in natural order.
+var testMozjpegTable3 = [64]int{
+	16, 16, 16, 18, 25, 37, 56, 85,
+	16, 17, 20, 27, 34, 40, 53, 75,
+	16, 20, 24, 31, 43, 62, 91, 135,
+	18, 27, 31, 40, 53, 74, 106, 156,
+	25, 34, 43, 53, 69, 94, 131, 189,
+	37, 40, 62, 74, 94, 124, 169, 238,
+	56, 53, 91, 106, 131, 169, 226, 311,
+	85, 75, 135, 156, 189, 238, 311, 418,
+}
+
+// zigzag returns the table in the zigzag order of DQT segments.
+func zigzag(table [64]int) []int {
+	values := make([]int, 64)
+	for i, natural := range testZigzag {
+		values[i] = table[natural]
+	}
+	return values
+}
+
+// scaleTable scales the base table to the quality like libjpeg.
+func scaleTable(table [64]int, quality int) [64]int {
+	scale := 200 - 2*quality
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	var scaled [64]int
+	for i, value := range table {
+		scaled[i] = (value*scale + 50) / 100
+		if scaled[i] < 1 {
+			scaled[i] = 1
+		} else if scaled[i] > 255 {
+			scaled[i] = 255
+		}
+	}
+	return scaled
+}
+
+// testDqtTable returns a table of a DQT segment with the given precision.
+func testDqtTable(id byte, sixteenBit bool, values []int) []byte {
+	if !sixteenBit {
+		table := []byte{id}
+		for _, value := range values {
+			table = append(table, byte(value))
+		}
+		return table
+	}
+	table := []byte{0x10 | id}
+	for _, value := range values {
+		table = append(table, byte(value>>8), byte(value))
+	}
+	return table
+}
+
+func testSegment(marker byte, data ...[]byte) []byte {
+	payload := bytes.Join(data, nil)
+	length := len(payload) + 2
+	return append([]byte{0xff, marker, byte(length >> 8), byte(length)}, payload...)
+}
+
+// testJpegHeader returns the segments between the SOI and an empty scan.
+func testJpegHeader(segments ...[]byte) []byte {
+	header := []byte{0xff, 0xd8}
+	for _, segment := range segments {
+		header = append(header, segment...)
+	}
+	return append(header, testSegment(0xda)...)
+}
+
+func TestReadLuminanceTable(t *testing.T) {
+	luminance := zigzag(testCjpegTable75)
+	chrominance := make([]int, 64)
+	for i := range chrominance {
+		chrominance[i] = 99
+	}
+	large := make([]int, 64)
+	for i := range large {
+		large[i] = 256 + i
+	}
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []int
+	}{
+		{
+			name:  "8-bit",
+			input: testJpegHeader(testSegment(0xdb, testDqtTable(0, false, luminance))),
+			want:  luminance,
+		},
+		{
+			name:  "16-bit",
+			input: testJpegHeader(testSegment(0xdb, testDqtTable(0, true, large))),
+			want:  large,
+		},
+		{
+			name: "tables in one segment",
+			input: testJpegHeader(testSegment(0xdb,
+				testDqtTable(1, false, chrominance),
+				testDqtTable(0, false, luminance))),
+			want: luminance,
+		},
+		{
+			name: "tables in separate segments",
+			input: testJpegHeader(
+				testSegment(0xdb, testDqtTable(1, false, chrominance)),
+				testSegment(0xdb, testDqtTable(0, false, luminance))),
+			want: luminance,
+		},
+		{
+			name: "after app segment",
+			input: testJpegHeader(
+				testSegment(0xe0, []byte("JFIF\x00\x01\x01\x00\x00\x01\x00\x01\x00\x00")),
+				testSegment(0xdb, testDqtTable(0, false, luminance))),
+			want: luminance,
+		},
+		{
+			name:  "missing table",
+			input: testJpegHeader(testSegment(0xdb, testDqtTable(1, false, chrominance))),
+		},
+		{
+			name:  "truncated table",
+			input: testJpegHeader(testSegment(0xdb, testDqtTable(0, false, luminance[:32]))),
+		},
+		{
+			name:  "not a jpeg",
+			input: testHeicHeader,
+		},
+	}
+	for _, test := range tests {
+		table, err := readLuminanceTable(bufio.NewReader(bytes.NewReader(test.input)))
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: got table %v, want an error", test.name, table)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if !reflect.DeepEqual(table, test.want) {
+			t.Errorf("%s: got table %v, want %v", test.name, table, test.want)
+		}
+	}
+}
+
+func TestEstimateJpegQuality(t *testing.T) {
+	tests := []struct {
+		name  string
+		table [64]int
+		want  int
+	}{
+		{"cjpeg 75", testCjpegTable75, 75},
+		{"ijg 10", scaleTable(standardTable(), 10), 10},
+		{"ijg 50", scaleTable(standardTable(), 50), 50},
+		{"ijg 90", scaleTable(standardTable(), 90), 90},
+		{"ijg 97", scaleTable(standardTable(), 97), 97},
+		{"mozjpeg table 3 at 75", scaleTable(testMozjpegTable3, 75), 0},
+		{"mozjpeg table 3 at 90", scaleTable(testMozjpegTable3, 90), 0},
+	}
+	for _, test := range tests {
+		input := testJpegHeader(testSegment(0xdb, testDqtTable(0, false, zigzag(test.table))))
+		quality, err := EstimateJpegQuality(bytes.NewReader(input))
+		if test.want == 0 {
+			if err == nil {
+				t.Errorf("%s: got quality %d, want the table to be rejected", test.name, quality)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if quality != test.want {
+			t.Errorf("%s: got quality %d, want %d", test.name, quality, test.want)
+		}
+	}
+}
+
+func TestEstimateJpegQualityEncoded(t *testing.T) {
+	for _, want := range []int{5, 30, 75, 85, 95, 100} {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, testImage(), &jpeg.Options{Quality: want}); err != nil {
+			t.Fatal(err)
+		}
+		quality, err := EstimateJpegQuality(&buf)
+		if err != nil {
+			t.Errorf("quality %d: %s", want, err)
+		} else if quality != want {
+			t.Errorf("got quality %d, want %d", quality, want)
+		}
+	}
+}
+
+// standardTable returns the standard luminance table in natural order.
+func standardTable() [64]int {
+	var table [64]int
+	for i, natural := range testZigzag {
+		table[natural] = standardLuminanceTable[i]
+	}
+	return table
+}
@@ -0,0 +1,111 @@
+package optimizer
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ToolLimits restricts the resources available to the processes of a tool.
+// Zero values mean no limit. The address space, cpu time and niceness limits
+// are only enforced on Linux.
+type ToolLimits struct {
+	// Maximum size of the virtual address space in bytes.
+	AddressSpace uint64
+	// Maximum cpu time used by the process.
+	CPUTime time.Duration
+	// Maximum time the process is allowed to run.
+	WallClock time.Duration
+	// Niceness the process runs with.
+	Niceness int
+	// Maximum number of processes of the tool running at the same time.
+	Concurrency int
+}
+
+// LimitError describes the limit that caused a process to be killed.
+type LimitError struct {
+	Limit string
+	Value string
+	// Set when the process failure could not be attributed to the limit with
+	// certainty.
+	Probable bool
+}
+
+func (e *LimitError) Error() string {
+	if e.Probable {
+		return "probably exceeded " + e.Limit + " limit of " + e.Value
+	}
+	return "exceeded " + e.Limit + " limit of " + e.Value
+}
+
+// ParseToolLimits parses limits in the form
+// "cwebp:memory=1G,cpu=30s,wall=1m,nice=10,concurrency=4;optipng:cpu=1m".
+func ParseToolLimits(spec string) (map[string]ToolLimits, error) {
+	toolLimits := make(map[string]ToolLimits)
+	for _, toolSpec := range strings.Split(spec, ";") {
+		toolSpec = strings.TrimSpace(toolSpec)
+		if toolSpec == "" {
+			continue
+		}
+		parts := strings.SplitN(toolSpec, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid tool limits: " + toolSpec)
+		}
+		limits, err := parseLimits(parts[1])
+		if err != nil {
+			return nil, errors.New("invalid limits for " + parts[0] + ": " + err.Error())
+		}
+		toolLimits[strings.TrimSpace(parts[0])] = limits
+	}
+	return toolLimits, nil
+}
+
+func parseLimits(spec string) (ToolLimits, error) {
+	var limits ToolLimits
+	for _, limit := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(limit), "=", 2)
+		if len(parts) != 2 {
+			return limits, errors.New("invalid limit: " + limit)
+		}
+		var err error
+		switch parts[0] {
+		case "memory":
+			limits.AddressSpace, err = parseBytes(parts[1])
+		case "cpu":
+			limits.CPUTime, err = time.ParseDuration(parts[1])
+		case "wall":
+			limits.WallClock, err = time.ParseDuration(parts[1])
+		case "nice":
+			limits.Niceness, err = strconv.Atoi(parts[1])
+		case "concurrency":
+			limits.Concurrency, err = strconv.Atoi(parts[1])
+		default:
+			err = errors.New("unknown limit " + parts[0])
+		}
+		if err != nil {
+			return limits, err
+		}
+	}
+	return limits, nil
+}
+
+func parseBytes(value string) (uint64, error) {
+	multiplier := uint64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
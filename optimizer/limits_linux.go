@@ -0,0 +1,96 @@
+package optimizer
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// applyLimits applies the limits to the started process. The process runs
+// without them until it is called.
+func applyLimits(pid int, limits ToolLimits) error {
+	if limits.AddressSpace > 0 {
+		err := prlimit(pid, syscall.RLIMIT_AS, limits.AddressSpace, limits.AddressSpace)
+		if err != nil {
+			return err
+		}
+	}
+	if limits.CPUTime > 0 {
+		// The soft limit delivers SIGXCPU which identifies the cause, the hard
+		// limit kills processes ignoring it.
+		seconds := uint64((limits.CPUTime + 999999999) / 1000000000)
+		err := prlimit(pid, syscall.RLIMIT_CPU, seconds, seconds+1)
+		if err != nil {
+			return err
+		}
+	}
+	if limits.Niceness != 0 {
+		err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, limits.Niceness)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func prlimit(pid int, resource int, cur, max uint64) error {
+	rlimit := syscall.Rlimit{
+		Cur: cur,
+		Max: max,
+	}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&rlimit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// exceededLimit returns the limit that most likely caused the process to fail.
+func exceededLimit(state *os.ProcessState, limits ToolLimits, stderr string) *LimitError {
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok {
+		return nil
+	}
+
+	// SIGKILL is also sent on cancellation, it only comes from the hard limit
+	// when the process used up the cpu time.
+	cpuTime := state.UserTime() + state.SystemTime()
+	if limits.CPUTime > 0 && status.Signaled() && (status.Signal() == syscall.SIGXCPU || (status.Signal() == syscall.SIGKILL && cpuTime >= limits.CPUTime)) {
+		return &LimitError{
+			Limit: "cpu time",
+			Value: limits.CPUTime.String(),
+		}
+	}
+
+	if limits.AddressSpace > 0 {
+		crashed := status.Signaled() && (status.Signal() == syscall.SIGSEGV || status.Signal() == syscall.SIGABRT)
+		stderr = strings.ToLower(stderr)
+		outOfMemory := strings.Contains(stderr, "memory") || strings.Contains(stderr, "alloc")
+		if crashed || outOfMemory {
+			return &LimitError{
+				Limit:    "address space",
+				Value:    strconv.FormatUint(limits.AddressSpace, 10) + " bytes",
+				Probable: true,
+			}
+		}
+	}
+	return nil
+}
+
+// crashed reports whether the process was killed by a signal of a crash.
+func crashed(state *os.ProcessState) bool {
+	if state == nil {
+		return false
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return false
+	}
+	switch status.Signal() {
+	case syscall.SIGSEGV, syscall.SIGBUS, syscall.SIGILL, syscall.SIGFPE, syscall.SIGABRT:
+		return true
+	}
+	return false
+}
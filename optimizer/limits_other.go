@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package optimizer
+
+import (
+	"os"
+)
+
+func applyLimits(pid int, limits ToolLimits) error {
+	return nil
+}
+
+func exceededLimit(state *os.ProcessState, limits ToolLimits, stderr string) *LimitError {
+	return nil
+}
+
+func crashed(state *os.ProcessState) bool {
+	return false
+}
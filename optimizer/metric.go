@@ -0,0 +1,150 @@
+package optimizer
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/arjantop/imageoptimizer/ssim"
+)
+
+// Metric measures the similarity of optimized images to the source image.
+// Higher scores are more similar, images scoring at least the threshold are
+// good enough.
+type Metric interface {
+	// Prepare prepares the source image once for all the images compared
+	// during a quality search.
+	Prepare(source image.Image) MetricReference
+	Threshold() float64
+}
+
+// MetricReference scores images against a prepared source image.
+type MetricReference interface {
+	Score(img image.Image) float64
+}
+
+var _ Metric = &SsimMetric{}
+var _ Metric = &AlphaSsimMetric{}
+var _ Metric = &ContentWeightedSsimMetric{}
+
+// SsimMetric compares the grayscale images with SSIM.
+type SsimMetric struct {
+	MinScore float64
+}
+
+func (m *SsimMetric) Prepare(source image.Image) MetricReference {
+	return &ssimReference{
+		reference: convertToGrayscale(source),
+		compare:   ssim.Ssim,
+	}
+}
+
+func (m *SsimMetric) Threshold() float64 {
+	return m.MinScore
+}
+
+// ContentWeightedSsimMetric compares the grayscale images with SSIM weighting
+// edges more than smooth and textured regions.
+type ContentWeightedSsimMetric struct {
+	MinScore float64
+}
+
+func (m *ContentWeightedSsimMetric) Prepare(source image.Image) MetricReference {
+	return &ssimReference{
+		reference: convertToGrayscale(source),
+		compare:   ssim.ContentWeightedSsim,
+	}
+}
+
+func (m *ContentWeightedSsimMetric) Threshold() float64 {
+	return m.MinScore
+}
+
+type ssimReference struct {
+	reference *image.Gray
+	compare   func(img1 *image.Gray, img2 *image.Gray) float64
+}
+
+func (r *ssimReference) Score(img image.Image) float64 {
+	return r.compare(r.reference, convertToGrayscale(img))
+}
+
+// AlphaSsimMetric compares the grayscale images with SSIM, ignoring the fully
+// transparent parts of the source.
+type AlphaSsimMetric struct {
+	MinScore float64
+}
+
+func (m *AlphaSsimMetric) Prepare(source image.Image) MetricReference {
+	return &alphaSsimReference{
+		reference: convertToGrayscale(source),
+		alpha:     extractAlphaChannel(source),
+	}
+}
+
+func (m *AlphaSsimMetric) Threshold() float64 {
+	return m.MinScore
+}
+
+type alphaSsimReference struct {
+	reference *image.Gray
+	alpha     *image.Alpha
+}
+
+func (r *alphaSsimReference) Score(img image.Image) float64 {
+	return ssim.SsimWithAlpha(r.reference, convertToGrayscale(img), r.alpha)
+}
+
+// metricName returns the metric in the form parsed by ParseMetric.
+func metricName(metric Metric) string {
+	var name string
+	switch metric.(type) {
+	case *SsimMetric:
+		name = "ssim"
+	case *AlphaSsimMetric:
+		name = "alpha-ssim"
+	case *ContentWeightedSsimMetric:
+		name = "cw-ssim"
+	default:
+		name = fmt.Sprintf("%T", metric)
+	}
+	return name + ":threshold=" + strconv.FormatFloat(metric.Threshold(), 'g', -1, 64)
+}
+
+// ParseMetric parses a metric in the form "ssim:threshold=0.995",
+// "alpha-ssim:threshold=0.998" or "cw-ssim:threshold=0.99".
+func ParseMetric(spec string) (Metric, error) {
+	parts := strings.SplitN(strings.TrimSpace(spec), ":", 2)
+	threshold := -1.0
+	if len(parts) == 2 {
+		for _, param := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 {
+				return nil, errors.New("invalid parameter: " + param)
+			}
+			if kv[0] != "threshold" {
+				return nil, errors.New("unknown parameter " + kv[0])
+			}
+			var err error
+			threshold, err = strconv.ParseFloat(kv[1], 64)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if threshold < 0 || threshold > 1 {
+		return nil, errors.New("missing or invalid threshold")
+	}
+
+	switch parts[0] {
+	case "ssim":
+		return &SsimMetric{MinScore: threshold}, nil
+	case "alpha-ssim":
+		return &AlphaSsimMetric{MinScore: threshold}, nil
+	case "cw-ssim":
+		return &ContentWeightedSsimMetric{MinScore: threshold}, nil
+	}
+	return nil, errors.New("unknown metric " + parts[0])
+}
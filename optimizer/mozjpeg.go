@@ -4,280 +4,362 @@ import (
 	"bufio"
 	"context"
 	"errors"
-	"image/jpeg"
+	"fmt"
+	"image"
+	"image/png"
 	"log"
 	"os"
-	"os/exec"
-	"path"
 	"strconv"
-
-	"image"
-
-	"fmt"
-
-	"image/png"
-
-	"github.com/arjantop/imageoptimizer/ssim"
-	"github.com/disintegration/gift"
+	"strings"
 )
 
 var _ ImageOptimizer = &MozjpegOptimizer{}
 
 type MozjpegOptimizer struct {
-	Args []string
+	Args     []string
+	Executor Executor
 }
 
 func (o *MozjpegOptimizer) CanOptimize(mimeType string, acceptedTypes []string) bool {
 	return mimeType == "image/jpeg" && isFiletypeAccepted(acceptedTypes, []string{"image/jpeg", "image/*", "*/*"})
 }
 
-func (o *MozjpegOptimizer) Optimize(ctx context.Context, sourcePath string, hidpi bool) (*ImageDescription, error) {
-	outputPath := tempFilename(os.TempDir(), path.Base(sourcePath))
-	args := make([]string, len(o.Args))
-	copy(args, o.Args)
-	cmd := exec.CommandContext(ctx, "jpegtran", append(args, sourcePath)...)
-
-	outputFile, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE, 0644)
+func (o *MozjpegOptimizer) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	input, err := source.Open()
 	if err != nil {
 		return nil, err
 	}
-	defer outputFile.Close()
-	bufWriter := bufio.NewWriter(outputFile)
-	cmd.Stdout = bufWriter
+	defer input.Close()
 
-	err = cmd.Run()
+	output, err := runPiped(ctx, o.Executor, input, "jpegtran", o.Args...)
 	if err != nil {
-		return nil, errors.New("transforming file with mozjpeg: " + err.Error())
+		return nil, &ToolError{Tool: "mozjpeg", Err: err}
 	}
 
-	err = bufWriter.Flush()
-	if err != nil {
-		return nil, err
+	return describeData(Name("mozjpeg"), output, "image/jpeg"), nil
+}
+
+// MozjpegSearchSpace lists the encoder settings searched in addition to the
+// quality. Empty lists leave the cjpeg defaults in place.
+type MozjpegSearchSpace struct {
+	// Chroma subsampling factors as accepted by cjpeg -sample, e.g. 2x2 for
+	// 4:2:0 or 1x1 for 4:4:4.
+	Subsamplings []string
+	// Quantization table presets as accepted by cjpeg -quant-table.
+	QuantTables []int
+	// Scan modes to try, true for progressive and false for baseline.
+	Progressive []bool
+}
+
+// DefaultMozjpegSearchSpace searches both subsamplings, which doubles the
+// quality searches. Quant tables and scan modes are opt-in.
+var DefaultMozjpegSearchSpace = MozjpegSearchSpace{
+	Subsamplings: []string{"2x2", "1x1"},
+}
+
+// ParseMozjpegSearchSpace parses a search space in the form
+// "sample=2x2,1x1;qt=3,2;scan=progressive,baseline". Settings that are not
+// given are left at the cjpeg defaults. Every searched setting multiplies the
+// number of encoder runs.
+func ParseMozjpegSearchSpace(spec string) (MozjpegSearchSpace, error) {
+	var searchSpace MozjpegSearchSpace
+	for _, settingSpec := range strings.Split(spec, ";") {
+		settingSpec = strings.TrimSpace(settingSpec)
+		if settingSpec == "" {
+			continue
+		}
+		parts := strings.SplitN(settingSpec, "=", 2)
+		if len(parts) != 2 {
+			return searchSpace, errors.New("invalid setting: " + settingSpec)
+		}
+		for _, value := range strings.Split(parts[1], ",") {
+			value = strings.TrimSpace(value)
+			switch parts[0] {
+			case "sample":
+				factors := strings.Split(value, "x")
+				if len(factors) != 2 {
+					return searchSpace, errors.New("invalid subsampling " + value)
+				}
+				for _, factor := range factors {
+					if n, err := strconv.Atoi(factor); err != nil || n < 1 || n > 4 {
+						return searchSpace, errors.New("invalid subsampling " + value)
+					}
+				}
+				searchSpace.Subsamplings = append(searchSpace.Subsamplings, value)
+			case "qt":
+				quantTable, err := strconv.Atoi(value)
+				if err != nil || quantTable < 0 || quantTable > 8 {
+					return searchSpace, errors.New("invalid quant table " + value)
+				}
+				searchSpace.QuantTables = append(searchSpace.QuantTables, quantTable)
+			case "scan":
+				if value != "progressive" && value != "baseline" {
+					return searchSpace, errors.New("invalid scan mode " + value)
+				}
+				searchSpace.Progressive = append(searchSpace.Progressive, value == "progressive")
+			default:
+				return searchSpace, errors.New("unknown setting " + parts[0])
+			}
+		}
 	}
+	return searchSpace, nil
+}
 
-	fileStat, err := os.Stat(outputPath)
-	if err != nil {
-		return nil, err
+type mozjpegSettings struct {
+	subsampling string
+	quantTable  int
+}
+
+func (s mozjpegSettings) args() []string {
+	args := make([]string, 0, 4)
+	if s.subsampling != "" {
+		args = append(args, "-sample", s.subsampling)
 	}
+	if s.quantTable >= 0 {
+		args = append(args, "-quant-table", strconv.Itoa(s.quantTable))
+	}
+	return args
+}
 
-	return &ImageDescription{
-		Optimizer: Name("mozjpeg"),
-		Path:      outputPath,
-		MimeType:  "image/jpeg",
-		Size:      fileStat.Size(),
-	}, nil
+func (s mozjpegSettings) String() string {
+	parts := make([]string, 0, 2)
+	if s.subsampling != "" {
+		parts = append(parts, "sample="+s.subsampling)
+	}
+	if s.quantTable >= 0 {
+		parts = append(parts, "qt="+strconv.Itoa(s.quantTable))
+	}
+	return strings.Join(parts, ",")
 }
 
+var _ VariantOptimizer = &mozjpegQualityOptimizer{}
+
 type mozjpegQualityOptimizer struct {
-	optimizePrecheck func(ctx context.Context, sourcePath string) (bool, error)
+	optimizePrecheck func(ctx context.Context, source *ImageDescription) (bool, error)
 	optimizerType    string
+	searchSpace      MozjpegSearchSpace
+	settings         mozjpegSettings
+	executor         Executor
 }
 
-func (o *mozjpegQualityOptimizer) OptimizePrecheck(ctx context.Context, sourcePath string) (bool, error) {
-	if o.optimizePrecheck != nil {
-		return o.optimizePrecheck(ctx, sourcePath)
-	} else {
-		return true, nil
+func newMozjpegQualityOptimizer(optimizerType string, searchSpace MozjpegSearchSpace) *mozjpegQualityOptimizer {
+	return &mozjpegQualityOptimizer{
+		optimizerType: optimizerType,
+		searchSpace:   searchSpace,
+		settings: mozjpegSettings{
+			quantTable: -1,
+		},
 	}
 }
 
-func convertToJpeg(sourcePath string) (string, error) {
-	sourcePathConverted := tempFilename(os.TempDir(), path.Base(sourcePath))
-	fileInput, err := os.Open(sourcePath)
-	if err != nil {
-		return "", err
+func (o *mozjpegQualityOptimizer) Variants() []ImageQualityOptimizer {
+	subsamplings := o.searchSpace.Subsamplings
+	if len(subsamplings) == 0 {
+		subsamplings = []string{o.settings.subsampling}
 	}
-	defer fileInput.Close()
-
-	fileOutput, err := os.Create(sourcePathConverted)
-	if err != nil {
-		return "", err
+	quantTables := o.searchSpace.QuantTables
+	if len(quantTables) == 0 {
+		quantTables = []int{o.settings.quantTable}
 	}
-	defer fileOutput.Close()
 
-	imgInput, err := png.Decode(fileInput)
-	if err != nil {
-		return "", err
-	}
-	err = jpeg.Encode(fileOutput, imgInput, &jpeg.Options{
-		Quality: 100,
-	})
-	if err != nil {
-		return "", err
+	variants := make([]ImageQualityOptimizer, 0, len(subsamplings)*len(quantTables))
+	for _, subsampling := range subsamplings {
+		for _, quantTable := range quantTables {
+			variant := *o
+			variant.settings = mozjpegSettings{
+				subsampling: subsampling,
+				quantTable:  quantTable,
+			}
+			variants = append(variants, &variant)
+		}
 	}
-	return sourcePathConverted, nil
+	return variants
 }
 
-func (o *mozjpegQualityOptimizer) OptimizeQuality(ctx context.Context, sourcePath string, quality int) (*ImageDescription, error) {
-	// TODO: Remove hack
-	realSourcePath := sourcePath
-	if o.optimizerType == "image/png" {
-		p, err := convertToJpeg(sourcePath)
-		if err != nil {
-			return nil, err
-		}
-		realSourcePath = p
+func (o *mozjpegQualityOptimizer) OptimizePrecheck(ctx context.Context, source *ImageDescription) (bool, error) {
+	if o.optimizePrecheck != nil {
+		return o.optimizePrecheck(ctx, source)
+	} else {
+		return true, nil
 	}
+}
 
-	outputPath := tempFilename(os.TempDir(), path.Base(sourcePath))
-	cmd := exec.CommandContext(ctx, "cjpeg", "-optimize", "-quality", strconv.Itoa(quality), realSourcePath)
+func (o *mozjpegQualityOptimizer) MaxQuality(source *ImageDescription) (int, bool) {
+	return jpegSourceQuality(o.optimizerType, source)
+}
 
-	outputFile, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE, 0644)
-	if err != nil {
-		return nil, err
+// PrepareSource converts png sources to a binary PPM which cjpeg reads
+// without loss, unlike an intermediate jpeg which would lose the chroma the
+// 1x1 subsampling variants are meant to keep.
+func (o *mozjpegQualityOptimizer) PrepareSource(ctx context.Context, source *ImageDescription) (*ImageDescription, func(), error) {
+	if o.optimizerType != "image/png" {
+		return source, func() {}, nil
 	}
-	defer outputFile.Close()
-	bufWriter := bufio.NewWriter(outputFile)
-	cmd.Stdout = bufWriter
 
-	err = cmd.Run()
+	file, err := source.Open()
 	if err != nil {
-		return nil, errors.New("transforming file with mozjpeg: " + err.Error())
+		return nil, nil, err
 	}
+	defer file.Close()
 
-	err = bufWriter.Flush()
+	img, err := png.Decode(file)
 	if err != nil {
-		return nil, err
+		return nil, nil, &DecodeError{Err: err}
 	}
 
-	fileStat, err := os.Stat(outputPath)
+	workspace := workspaceFrom(ctx)
+	outputPath := workspace.TempFilename(".ppm")
+	err = writePpm(outputPath, img)
 	if err != nil {
-		return nil, err
+		workspace.Remove(outputPath)
+		return nil, nil, err
+	}
+	size, err := workspace.Track(outputPath)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return &ImageDescription{
-		Optimizer: Name(fmt.Sprintf("mozjpeg-lossy[%s]", o.optimizerType)),
+	prepared := &ImageDescription{
+		Optimizer: Name("ppm"),
 		Path:      outputPath,
-		MimeType:  "image/jpeg",
-		Size:      fileStat.Size(),
-	}, nil
+		MimeType:  "image/x-portable-pixmap",
+		Size:      size,
+	}
+	return prepared, func() { workspace.Remove(outputPath) }, nil
 }
 
-func (o *mozjpegQualityOptimizer) CompareImages(ctx context.Context, sourcePath string, imageDesc *ImageDescription, hidpi bool) (float64, error) {
-	// TODO: Remove hack
-	if o.optimizerType == "image/png" {
-		file1, err := os.Open(sourcePath)
-		if err != nil {
-			return 0, err
-		}
-		defer file1.Close()
-		img1, err := png.Decode(file1)
-		if err != nil {
-			return 0, err
-		}
-
-		file2, err := os.Open(imageDesc.Path)
-		if err != nil {
-			return 0, err
-		}
-		defer file2.Close()
-
-		img2, err := jpeg.Decode(file2)
-		if err != nil {
-			return 0, err
+// writePpm writes the colors of the opaque image as a binary PPM.
+func writePpm(filePath string, img image.Image) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	bounds := img.Bounds()
+	fmt.Fprintf(w, "P6\n%d %d\n255\n", bounds.Dx(), bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			w.Write([]byte{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8)})
 		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
 
-		if hidpi {
-			g := gift.New(
-				gift.Resize(img1.Bounds().Dx()/2, 0, gift.LanczosResampling),
-			)
-
-			resized1 := image.NewRGBA(g.Bounds(img1.Bounds()))
-			g.Draw(resized1, img1)
-			img1 = resized1
-			resized2 := image.NewRGBA(g.Bounds(img2.Bounds()))
-			g.Draw(resized2, img2)
-			img2 = resized2
-		}
+func (o *mozjpegQualityOptimizer) OptimizeQuality(ctx context.Context, source *ImageDescription, quality int) (*ImageDescription, error) {
+	args := append([]string{"-optimize", "-quality", strconv.Itoa(quality)}, o.settings.args()...)
+	name := o.settings.String()
 
-		return ssim.Ssim(convertToGrayscale(img1), convertToGrayscale(img2)), nil
-	} else {
+	// The scan mode does not change the decoded image, so only the smallest
+	// encoding is kept instead of searching the quality for each of them.
+	if len(o.searchSpace.Progressive) == 0 {
+		return o.encode(ctx, source, args, name)
+	}
 
-		file1, err := os.Open(sourcePath)
-		if err != nil {
-			return 0, err
+	var best *ImageDescription
+	for _, progressive := range o.searchSpace.Progressive {
+		scanArgs := append(args[:len(args):len(args)], "-baseline")
+		scanName := "baseline"
+		if progressive {
+			scanArgs[len(scanArgs)-1] = "-progressive"
+			scanName = "progressive"
 		}
-		defer file1.Close()
-		img1, err := jpeg.Decode(file1)
-		if err != nil {
-			return 0, err
+		if name != "" {
+			scanName = name + "," + scanName
 		}
 
-		file2, err := os.Open(imageDesc.Path)
+		imageDesc, err := o.encode(ctx, source, scanArgs, scanName)
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		defer file2.Close()
-
-		img2, err := jpeg.Decode(file2)
-		if err != nil {
-			return 0, err
+		if best == nil || imageDesc.Size < best.Size {
+			best = imageDesc
 		}
+	}
+	return best, nil
+}
 
-		if hidpi {
-			g := gift.New(
-				gift.Resize(img1.Bounds().Dx()/2, 0, gift.LanczosResampling),
-			)
-
-			resized1 := image.NewRGBA(g.Bounds(img1.Bounds()))
-			g.Draw(resized1, img1)
-			img1 = resized1
-			resized2 := image.NewRGBA(g.Bounds(img2.Bounds()))
-			g.Draw(resized2, img2)
-			img2 = resized2
-		}
+func (o *mozjpegQualityOptimizer) encode(ctx context.Context, source *ImageDescription, args []string, settingsName string) (*ImageDescription, error) {
+	input, err := source.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	output, err := runPiped(ctx, o.executor, input, "cjpeg", args...)
+	if err != nil {
+		return nil, &ToolError{Tool: "mozjpeg", Err: err}
+	}
 
-		return ssim.Ssim(convertToGrayscale(img1), convertToGrayscale(img2)), nil
+	optimizerName := o.optimizerType
+	if settingsName != "" {
+		optimizerName += ";" + settingsName
 	}
+
+	return describeData(Name(fmt.Sprintf("mozjpeg-lossy[%s]", optimizerName)), output, "image/jpeg"), nil
 }
 
 func (o *mozjpegQualityOptimizer) CanOptimize(mimeType string, acceptedTypes []string) bool {
 	return mimeType == o.optimizerType && isFiletypeAccepted(acceptedTypes, []string{"image/jpeg", "image/*", "*/*"})
 }
 
-func (o *mozjpegQualityOptimizer) Optimize(ctx context.Context, sourcePath string, hidpi bool) (*ImageDescription, error) {
-	return o.OptimizeQuality(ctx, sourcePath, 100)
+func (o *mozjpegQualityOptimizer) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	input, cleanup, err := o.PrepareSource(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	return o.OptimizeQuality(ctx, input, 100)
 }
 
-func NewMozjpegPngLossyOptimizer(minSsim float64) ImageOptimizer {
-	opt := &mozjpegQualityOptimizer{
-		optimizerType: "image/png",
-		optimizePrecheck: func(ctx context.Context, sourcePath string) (bool, error) {
-			file, err := os.Open(sourcePath)
-			if err != nil {
-				return false, err
-			}
-			defer file.Close()
-
-			img, err := png.Decode(file)
-			if err != nil {
-				return false, err
-			}
-
-			for y := 0; y < img.Bounds().Max.Y; y++ {
-				for x := 0; x < img.Bounds().Max.X; x++ {
-					_, _, _, a := img.At(x, y).RGBA()
-					if a < uint32(^uint16(0)) {
-						log.Println("Image has transparency")
-						return false, nil
-					}
-				}
-			}
-			return true, nil
-		},
-	}
+// NewMozjpegPngLossyOptimizer returns an optimizer encoding opaque png images
+// to jpeg with cjpeg run by the executor, DefaultExecutor when nil.
+func NewMozjpegPngLossyOptimizer(metric Metric, searchSpace MozjpegSearchSpace, executor Executor) ImageOptimizer {
+	opt := newMozjpegQualityOptimizer("image/png", searchSpace)
+	opt.executor = executor
+	opt.optimizePrecheck = isOpaquePng
 	return &AutomaticOptimizer{
 		Optimizer: opt,
-		MinSsim:   minSsim,
+		Metric:    metric,
 	}
 }
 
-func NewMozjpegLossyOptimizer(minSsim float64) ImageOptimizer {
-	opt := &mozjpegQualityOptimizer{
-		optimizerType: "image/jpeg",
-	}
+func NewMozjpegLossyOptimizer(metric Metric, searchSpace MozjpegSearchSpace, executor Executor) ImageOptimizer {
+	opt := newMozjpegQualityOptimizer("image/jpeg", searchSpace)
+	opt.executor = executor
 	return &AutomaticOptimizer{
 		Optimizer: opt,
-		MinSsim:   minSsim,
+		Metric:    metric,
+	}
+}
+
+// isOpaquePng reports whether the png image has no transparent pixels and
+// can be converted to a jpeg.
+func isOpaquePng(ctx context.Context, source *ImageDescription) (bool, error) {
+	file, err := source.Open()
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	img, err := png.Decode(file)
+	if err != nil {
+		return false, &DecodeError{Err: err}
+	}
+
+	for y := 0; y < img.Bounds().Max.Y; y++ {
+		for x := 0; x < img.Bounds().Max.X; x++ {
+			_, _, _, a := img.At(x, y).RGBA()
+			if a < uint32(^uint16(0)) {
+				log.Println("Image has transparency")
+				return false, nil
+			}
+		}
 	}
+	return true, nil
 }
@@ -0,0 +1,212 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func commandQuality(cmd *Command) int {
+	for i, arg := range cmd.Args {
+		if arg == "-quality" && i+1 < len(cmd.Args) {
+			quality, _ := strconv.Atoi(cmd.Args[i+1])
+			return quality
+		}
+	}
+	return -1
+}
+
+// fakeCjpeg encodes the jpeg on the standard input with the requested quality
+// using the standard library encoder.
+func fakeCjpeg(ctx context.Context, cmd *Command) error {
+	quality := commandQuality(cmd)
+	if quality < 0 {
+		return errors.New("fake cjpeg: no quality")
+	}
+	if quality < 1 {
+		quality = 1
+	}
+	img, err := jpeg.Decode(cmd.Stdin)
+	if err != nil {
+		return err
+	}
+	return jpeg.Encode(cmd.Stdout, img, &jpeg.Options{Quality: quality})
+}
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), uint8((x * y) % 256), 255})
+		}
+	}
+	return img
+}
+
+func testJpeg(t *testing.T, quality int) *ImageDescription {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(), &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return describeData("original", buf.Bytes(), "image/jpeg")
+}
+
+func TestMozjpegLossyOptimizerUsesExecutor(t *testing.T) {
+	ctx, cleanup := testWorkspace(t)
+	defer cleanup()
+
+	executor := NewFakeExecutor()
+	executor.Handle("cjpeg", fakeCjpeg)
+	source := testJpeg(t, 95)
+	optimizer := NewMozjpegLossyOptimizer(&SsimMetric{MinScore: 0.98}, MozjpegSearchSpace{}, executor)
+
+	desc, err := optimizer.Optimize(ctx, source, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc == nil || desc.MimeType != "image/jpeg" {
+		t.Fatalf("got %v, want a jpeg image", desc)
+	}
+	if desc.Size >= source.Size {
+		t.Errorf("got %d bytes, want less than the %d bytes of the source", desc.Size, source.Size)
+	}
+	commands := executor.Commands()
+	if len(commands) == 0 {
+		t.Fatal("no commands run by the executor")
+	}
+	for _, cmd := range commands {
+		if cmd.Name != "cjpeg" {
+			t.Errorf("unexpected command %s", cmd.Name)
+		}
+	}
+	if len(desc.Probes) == 0 || len(desc.Probes) > len(commands) {
+		t.Errorf("got %d probes for %d commands", len(desc.Probes), len(commands))
+	}
+}
+
+func TestWebpLossyOptimizerMissingTool(t *testing.T) {
+	ctx, cleanup := testWorkspace(t)
+	defer cleanup()
+
+	optimizer := NewWebpLossyJpegOptimizer(&AlphaSsimMetric{MinScore: 0.99}, NewFakeExecutor())
+	_, err := optimizer.Optimize(ctx, testJpeg(t, 90), 1)
+	if kind := ErrorKind(err); kind != "tool_missing" {
+		t.Errorf("got kind %s (%v), want tool_missing", kind, err)
+	}
+}
+
+func TestMozjpegPngLossyOptimizerReadsPpm(t *testing.T) {
+	ctx, cleanup := testWorkspace(t)
+	defer cleanup()
+
+	img := testImage()
+	var source bytes.Buffer
+	if err := png.Encode(&source, img); err != nil {
+		t.Fatal(err)
+	}
+	wantHeader := "P6\n64 64\n255\n"
+	executor := NewFakeExecutor()
+	executor.Handle("cjpeg", func(ctx context.Context, cmd *Command) error {
+		input, err := ioutil.ReadAll(cmd.Stdin)
+		if err != nil {
+			return err
+		}
+		if len(input) != len(wantHeader)+64*64*3 || string(input[:len(wantHeader)]) != wantHeader {
+			return errors.New("fake cjpeg: input is not the ppm of the source")
+		}
+		return jpeg.Encode(cmd.Stdout, img, &jpeg.Options{Quality: commandQuality(cmd)})
+	})
+	searchSpace := MozjpegSearchSpace{Subsamplings: []string{"2x2", "1x1"}}
+	optimizer := NewMozjpegPngLossyOptimizer(&SsimMetric{MinScore: 0.98}, searchSpace, executor)
+
+	desc, err := optimizer.Optimize(ctx, describeData("original", source.Bytes(), "image/png"), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc == nil || desc.MimeType != "image/jpeg" {
+		t.Fatalf("got %v, want a jpeg image", desc)
+	}
+}
+
+func TestParseMozjpegSearchSpace(t *testing.T) {
+	tests := []struct {
+		spec string
+		want MozjpegSearchSpace
+	}{
+		{"", MozjpegSearchSpace{}},
+		{"sample=2x2,1x1", DefaultMozjpegSearchSpace},
+		{"sample=2x2,1x1;qt=3,2;scan=progressive,baseline", MozjpegSearchSpace{
+			Subsamplings: []string{"2x2", "1x1"},
+			QuantTables:  []int{3, 2},
+			Progressive:  []bool{true, false},
+		}},
+		{"sample=1x1", MozjpegSearchSpace{Subsamplings: []string{"1x1"}}},
+		{"qt=3; scan=baseline", MozjpegSearchSpace{QuantTables: []int{3}, Progressive: []bool{false}}},
+	}
+	for _, test := range tests {
+		got, err := ParseMozjpegSearchSpace(test.spec)
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.spec, got, test.want)
+		}
+	}
+
+	for _, spec := range []string{"sample=2", "sample=0x1", "qt=9", "scan=interlaced", "quality=80", "sample"} {
+		if _, err := ParseMozjpegSearchSpace(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
+
+func TestWebpLossyOptimizerWritesSourceOnce(t *testing.T) {
+	ctx, cleanup := testWorkspace(t)
+	defer cleanup()
+
+	// The fake encodes a jpeg instead of a webp, the comparison decodes any
+	// registered format.
+	executor := NewFakeExecutor()
+	executor.Handle("cwebp", func(ctx context.Context, cmd *Command) error {
+		quality, err := strconv.Atoi(cmd.Args[1])
+		if err != nil {
+			return err
+		}
+		file, err := os.Open(cmd.Args[len(cmd.Args)-1])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		img, err := jpeg.Decode(file)
+		if err != nil {
+			return err
+		}
+		return jpeg.Encode(cmd.Stdout, img, &jpeg.Options{Quality: quality})
+	})
+	optimizer := NewWebpLossyJpegOptimizer(&SsimMetric{MinScore: 0.98}, executor)
+
+	if _, err := optimizer.Optimize(ctx, testJpeg(t, 95), 1); err != nil {
+		t.Fatal(err)
+	}
+	commands := executor.Commands()
+	if len(commands) < 2 {
+		t.Fatalf("got %d commands, want a quality search", len(commands))
+	}
+	sourcePath := commands[0].Args[len(commands[0].Args)-1]
+	for _, cmd := range commands[1:] {
+		if path := cmd.Args[len(cmd.Args)-1]; path != sourcePath {
+			t.Errorf("got source %s, want every probe to read %s", path, sourcePath)
+		}
+	}
+	if _, err := os.Stat(sourcePath); !os.IsNotExist(err) {
+		t.Errorf("source file %s not removed", sourcePath)
+	}
+}
@@ -0,0 +1,154 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+)
+
+var _ ImageOptimizer = &NativePngOptimizer{}
+
+// NativePngOptimizer recompresses png images with the encoder from the
+// standard library. Images with at most 256 colors are stored as paletted.
+type NativePngOptimizer struct {
+	CompressionLevel png.CompressionLevel
+}
+
+func (o *NativePngOptimizer) CanOptimize(mimeType string, acceptedTypes []string) bool {
+	return mimeType == "image/png" && isFiletypeAccepted(acceptedTypes, []string{"image/png", "image/*", "*/*"})
+}
+
+func (o *NativePngOptimizer) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	img, err := decodeImage(source)
+	if err != nil {
+		return nil, err
+	}
+	if paletted := toPaletted(img); paletted != nil {
+		img = paletted
+	}
+
+	encoder := &png.Encoder{
+		CompressionLevel: o.CompressionLevel,
+	}
+	var output bytes.Buffer
+	err = encoder.Encode(&output, img)
+	if err != nil {
+		return nil, errors.New("encoding png: " + err.Error())
+	}
+
+	return describeData(Name("png"), output.Bytes(), "image/png"), nil
+}
+
+// toPaletted returns a paletted copy of the image if it uses at most 256
+// distinct colors and nil otherwise.
+func toPaletted(img image.Image) *image.Paletted {
+	if _, ok := img.(*image.Paletted); ok {
+		return nil
+	}
+
+	bounds := img.Bounds()
+	palette := make(color.Palette, 0, 256)
+	indices := make(map[color.NRGBA]uint8)
+	paletted := image.NewPaletted(bounds, nil)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c64 := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			if c64.R%257 != 0 || c64.G%257 != 0 || c64.B%257 != 0 || c64.A%257 != 0 {
+				// Palette entries can only hold 8 bits per channel.
+				return nil
+			}
+			c := color.NRGBA{
+				R: uint8(c64.R >> 8),
+				G: uint8(c64.G >> 8),
+				B: uint8(c64.B >> 8),
+				A: uint8(c64.A >> 8),
+			}
+			index, ok := indices[c]
+			if !ok {
+				if len(palette) == 256 {
+					return nil
+				}
+				index = uint8(len(palette))
+				indices[c] = index
+				palette = append(palette, c)
+			}
+			paletted.SetColorIndex(x, y, index)
+		}
+	}
+	paletted.Palette = palette
+	return paletted
+}
+
+var _ ImageQualityOptimizer = &nativeJpegQualityOptimizer{}
+
+// nativeJpegQualityOptimizer encodes jpeg images with the encoder from the
+// standard library.
+type nativeJpegQualityOptimizer struct {
+	optimizePrecheck func(ctx context.Context, source *ImageDescription) (bool, error)
+	optimizerType    string
+}
+
+func (o *nativeJpegQualityOptimizer) OptimizePrecheck(ctx context.Context, source *ImageDescription) (bool, error) {
+	if o.optimizePrecheck != nil {
+		return o.optimizePrecheck(ctx, source)
+	}
+	return true, nil
+}
+
+func (o *nativeJpegQualityOptimizer) MaxQuality(source *ImageDescription) (int, bool) {
+	return jpegSourceQuality(o.optimizerType, source)
+}
+
+func (o *nativeJpegQualityOptimizer) OptimizeQuality(ctx context.Context, source *ImageDescription, quality int) (*ImageDescription, error) {
+	img, err := decodeImage(source)
+	if err != nil {
+		return nil, err
+	}
+
+	if quality < 1 {
+		quality = 1
+	}
+	var output bytes.Buffer
+	err = jpeg.Encode(&output, img, &jpeg.Options{
+		Quality: quality,
+	})
+	if err != nil {
+		return nil, errors.New("encoding jpeg: " + err.Error())
+	}
+
+	return describeData(Name(fmt.Sprintf("jpeg-lossy[%s]", o.optimizerType)), output.Bytes(), "image/jpeg"), nil
+}
+
+func (o *nativeJpegQualityOptimizer) CanOptimize(mimeType string, acceptedTypes []string) bool {
+	return mimeType == o.optimizerType && isFiletypeAccepted(acceptedTypes, []string{"image/jpeg", "image/*", "*/*"})
+}
+
+func (o *nativeJpegQualityOptimizer) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	return o.OptimizeQuality(ctx, source, 100)
+}
+
+func NewNativePngLossyOptimizer(metric Metric) ImageOptimizer {
+	opt := &nativeJpegQualityOptimizer{
+		optimizerType:    "image/png",
+		optimizePrecheck: isOpaquePng,
+	}
+	return &AutomaticOptimizer{
+		Optimizer: opt,
+		Metric:    metric,
+	}
+}
+
+func NewNativeJpegLossyOptimizer(metric Metric) ImageOptimizer {
+	opt := &nativeJpegQualityOptimizer{
+		optimizerType: "image/jpeg",
+	}
+	return &AutomaticOptimizer{
+		Optimizer: opt,
+		Metric:    metric,
+	}
+}
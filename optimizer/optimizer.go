@@ -1,10 +1,14 @@
 package optimizer
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
+	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"runtime"
 )
 
 type Name string
@@ -12,13 +16,60 @@ type Name string
 type ImageDescription struct {
 	Optimizer Name
 	Path      string
-	MimeType  string
-	Size      int64
+	// Contents of the image when it is held in memory instead of in the
+	// file at Path.
+	Data            []byte
+	MimeType        string
+	ContentEncoding string
+	Size            int64
+	// Qualities tried by the quality search that produced the image.
+	Probes []Probe
+}
+
+// Open returns a reader for the contents of the image.
+func (d *ImageDescription) Open() (io.ReadCloser, error) {
+	if d.Data != nil {
+		return ioutil.NopCloser(bytes.NewReader(d.Data)), nil
+	}
+	return os.Open(d.Path)
+}
+
+// Bytes returns the contents of the image.
+func (d *ImageDescription) Bytes() ([]byte, error) {
+	if d.Data != nil {
+		return d.Data, nil
+	}
+	return ioutil.ReadFile(d.Path)
+}
+
+// File returns the path of a file holding the image for tools that cannot
+// read from standard input. The returned function removes the file if it had
+// to be created in the workspace.
+func (d *ImageDescription) File(ctx context.Context) (string, func(), error) {
+	if d.Data == nil {
+		return d.Path, func() {}, nil
+	}
+
+	workspace := workspaceFrom(ctx)
+	filePath, err := workspace.WriteFile(extension(d.MimeType), d.Data)
+	if err != nil {
+		return "", nil, err
+	}
+	return filePath, func() { workspace.Remove(filePath) }, nil
+}
+
+func describeData(optimizer Name, data []byte, mimeType string) *ImageDescription {
+	return &ImageDescription{
+		Optimizer: optimizer,
+		Data:      data,
+		MimeType:  mimeType,
+		Size:      int64(len(data)),
+	}
 }
 
 type ImageOptimizer interface {
 	CanOptimize(mimeType string, acceptedTypes []string) bool
-	Optimize(ctx context.Context, sourcePath string, hidpi bool) (*ImageDescription, error)
+	Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error)
 }
 
 type bySize []*ImageDescription
@@ -35,38 +86,79 @@ func (s bySize) Less(i, j int) bool {
 	return s[i].Size < s[j].Size
 }
 
-var DefaultPool = NewTaskPool()
+var DefaultPool = NewTaskPool(runtime.NumCPU(), 256)
 
 type OptimizeParams struct {
 	AcceptedTypes []string
-	SourcePath    string
-	Hidpi         bool
+	// Quality values of the accepted types, used by AcceptPolicy.
+	TypePreferences map[string]float64
+	SourcePath      string
+	// Contents of the source image, used instead of SourcePath when set.
+	SourceData []byte
+	// Content type reported by the origin server.
+	ContentType string
+	// Device pixel ratio the image is displayed at. The optimized images are
+	// compared to the source at the size in CSS pixels, ratios up to 1 compare
+	// them at their full size.
+	Dpr float64
+	// Limits the source image is checked against before optimization.
+	InputLimits InputLimits
+	Priority    Priority
+	// Asks the lossy optimizers for the highest quality fitting into the
+	// budget when set.
+	ByteBudget ByteBudget
 }
 
-func Optimize(ctx context.Context, optimizers []ImageOptimizer, params OptimizeParams) (*ImageDescription, error) {
-	header := make([]byte, 512)
-	file, err := os.Open(params.SourcePath)
-	if err != nil {
-		return nil, err
+// Optimize chooses the best of the images produced by the suitable optimizers.
+// Without a workspace in the context the intermediate files are stored in a
+// new workspace which is removed before returning. An UnsupportedInputError is
+// returned when none of the optimizers is suitable.
+func Optimize(ctx context.Context, optimizers []ImageOptimizer, params OptimizeParams) (result *Result, err error) {
+	workspace := workspaceFrom(ctx)
+	if workspace == nil {
+		workspace, err = NewWorkspace(DefaultWorkspaceDir, DefaultWorkspaceQuota)
+		if err != nil {
+			return nil, err
+		}
+		defer workspace.Close()
+		ctx = WithWorkspace(ctx, workspace)
+		defer func() {
+			if err == nil {
+				result.Image, err = workspace.load(result.Image)
+			}
+		}()
 	}
-	_, err = file.Read(header)
+
+	originalImage, err := describeSource(params)
 	if err != nil {
 		return nil, err
 	}
-	originalStat, err := file.Stat()
+	originalType := originalImage.MimeType
+	log.Printf("Detected file type: %s", originalType)
+
+	err = checkInput(originalImage, params.InputLimits)
 	if err != nil {
 		return nil, err
 	}
 
-	originalType := http.DetectContentType(header)
-	log.Printf("Detected file type: %s", originalType)
-	originalSize := originalStat.Size()
-
-	originalImage := &ImageDescription{
-		Optimizer: Name("original"),
-		Path:      params.SourcePath,
-		MimeType:  originalType,
-		Size:      originalSize,
+	if transcoder := findTranscoder(DefaultTranscoders, originalType); transcoder != nil {
+		originalImage, err = transcoder.Transcode(ctx, originalImage)
+		if err != nil {
+			return nil, err
+		}
+		originalType = originalImage.MimeType
+		log.Printf("Transcoded to: %s", originalType)
+
+		// The dimensions of formats without a registered decoder, such as
+		// HEIC, are only known after transcoding. The lossless output is
+		// expected to be larger than the source, so its size is not checked.
+		transcodedLimits := params.InputLimits
+		transcodedLimits.MaxBytes = 0
+		err = checkInput(originalImage, transcodedLimits)
+		if err != nil {
+			workspace.Discard(originalImage)
+			return nil, err
+		}
 	}
 
 	suitableOptimizers := make([]ImageOptimizer, 0, len(optimizers))
@@ -77,17 +169,55 @@ func Optimize(ctx context.Context, optimizers []ImageOptimizer, params OptimizeP
 	}
 
 	if len(suitableOptimizers) == 0 {
-		return nil, nil
+		return nil, &UnsupportedInputError{MimeType: originalType}
 	}
 
 	return DefaultPool.Do(ctx, &Task{
-		OriginalImage: originalImage,
-		Optimizers:    suitableOptimizers,
-		Hidpi:         params.Hidpi,
+		OriginalImage:   originalImage,
+		Optimizers:      suitableOptimizers,
+		Dpr:             params.Dpr,
+		Priority:        params.Priority,
+		TypePreferences: params.TypePreferences,
+		ByteBudget:      params.ByteBudget,
 	})
 }
 
+func describeSource(params OptimizeParams) (*ImageDescription, error) {
+	if params.SourceData != nil {
+		header := params.SourceData
+		if len(header) > 512 {
+			header = header[:512]
+		}
+		return describeData(Name("original"), params.SourceData, detectContentType(header, params.ContentType)), nil
+	}
+
+	header := make([]byte, 512)
+	file, err := os.Open(params.SourcePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	n, err := file.Read(header)
+	if err != nil {
+		return nil, errors.New("reading source header: " + err.Error())
+	}
+	originalStat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageDescription{
+		Optimizer: Name("original"),
+		Path:      params.SourcePath,
+		MimeType:  detectContentType(header[:n], params.ContentType),
+		Size:      originalStat.Size(),
+	}, nil
+}
+
 func CanOptimize(optimizers []ImageOptimizer, mimeType string, acceptedTyped []string) bool {
+	if findTranscoder(DefaultTranscoders, mimeType) != nil {
+		mimeType = "image/png"
+	}
 	for _, opt := range optimizers {
 		if opt.CanOptimize(mimeType, acceptedTyped) {
 			return true
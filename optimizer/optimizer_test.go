@@ -0,0 +1,102 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"testing"
+)
+
+// Header of a HEIC file, the ftyp box with the heic brand.
+var testHeicHeader = []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic")
+
+func TestOptimizeChecksTranscodedDimensions(t *testing.T) {
+	ctx, cleanup := testWorkspace(t)
+	defer cleanup()
+
+	var converted bytes.Buffer
+	if err := png.Encode(&converted, image.NewGray(image.Rect(0, 0, 200, 100))); err != nil {
+		t.Fatal(err)
+	}
+	executor := NewFakeExecutor()
+	executor.Handle("heif-convert", func(ctx context.Context, cmd *Command) error {
+		return ioutil.WriteFile(cmd.Args[len(cmd.Args)-1], converted.Bytes(), 0644)
+	})
+	defaultExecutor := DefaultExecutor
+	DefaultExecutor = executor
+	defer func() { DefaultExecutor = defaultExecutor }()
+
+	_, err := Optimize(ctx, []ImageOptimizer{&OptipngOptimizer{Executor: executor}}, OptimizeParams{
+		AcceptedTypes: []string{"image/png"},
+		SourceData:    testHeicHeader,
+		InputLimits: InputLimits{
+			MaxWidth: 100,
+			MaxBytes: int64(len(testHeicHeader)),
+		},
+	})
+	rejected, ok := err.(*InputRejectedError)
+	if !ok || rejected.Reason != "width" {
+		t.Errorf("got %v, want the width to be rejected", err)
+	}
+	if len(executor.Commands()) != 1 {
+		t.Errorf("got %d commands, want only heif-convert to run", len(executor.Commands()))
+	}
+}
+
+func TestCheckTranscodersWithoutHeifConvert(t *testing.T) {
+	caps := ProbeCapabilities(context.Background(), NewFakeExecutor(), DefaultToolSpecs)
+	transcoders := CheckTranscoders(DefaultTranscoders, caps)
+	if findTranscoder(transcoders, "image/heic") != nil {
+		t.Error("heic transcoder enabled without heif-convert")
+	}
+	if findTranscoder(transcoders, "image/tiff") == nil {
+		t.Error("tiff transcoder disabled")
+	}
+
+	defaultTranscoders := DefaultTranscoders
+	DefaultTranscoders = transcoders
+	defer func() { DefaultTranscoders = defaultTranscoders }()
+
+	optimizers := []ImageOptimizer{&OptipngOptimizer{}}
+	if CanOptimize(optimizers, "image/heic", []string{"image/png"}) {
+		t.Error("heic reported as optimizable without heif-convert")
+	}
+	if !CanOptimize(optimizers, "image/tiff", []string{"image/png"}) {
+		t.Error("tiff reported as not optimizable")
+	}
+}
+
+func TestCheckInput(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 200, 100))); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+	limits := InputLimits{MaxWidth: 300, MaxHeight: 300, MaxPixels: 30000, MaxBytes: 1 << 20}
+
+	tests := []struct {
+		name   string
+		data   []byte
+		limits InputLimits
+		kind   string
+	}{
+		{name: "within limits", data: valid, limits: limits},
+		{name: "width", data: valid, limits: InputLimits{MaxWidth: 100}, kind: "input_rejected"},
+		{name: "pixels", data: valid, limits: InputLimits{MaxPixels: 10000}, kind: "input_rejected"},
+		{name: "bytes", data: valid, limits: InputLimits{MaxBytes: 10}, kind: "input_rejected"},
+		{name: "corrupt header", data: valid[:20], limits: limits, kind: "decode"},
+		{name: "unknown format", data: testHeicHeader, limits: limits},
+	}
+	for _, test := range tests {
+		err := checkInput(describeData("original", test.data, "image/png"), test.limits)
+		kind := ""
+		if err != nil {
+			kind = ErrorKind(err)
+		}
+		if kind != test.kind {
+			t.Errorf("%s: got kind %q (%v), want %q", test.name, kind, err, test.kind)
+		}
+	}
+}
@@ -2,31 +2,36 @@ package optimizer
 
 import (
 	"context"
-	"errors"
-	"os"
-	"os/exec"
-	"path"
 )
 
 var _ ImageOptimizer = &OptipngOptimizer{}
 
 type OptipngOptimizer struct {
-	Args []string
+	Args     []string
+	Executor Executor
 }
 
 func (o *OptipngOptimizer) CanOptimize(mimeType string, acceptedTypes []string) bool {
 	return mimeType == "image/png" && isFiletypeAccepted(acceptedTypes, []string{"image/png", "image/*", "*/*"})
 }
 
-func (o *OptipngOptimizer) Optimize(ctx context.Context, sourcePath string, hidpi bool) (*ImageDescription, error) {
-	outputPath := tempFilename(os.TempDir(), path.Base(sourcePath))
+func (o *OptipngOptimizer) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	sourcePath, cleanup, err := source.File(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	workspace := workspaceFrom(ctx)
+	outputPath := workspace.TempFilename(".png")
 	args := []string{sourcePath, "-out", outputPath}
-	err := exec.CommandContext(ctx, "optipng", append(args, o.Args...)...).Run()
+	err = run(ctx, o.Executor, "optipng", append(args, o.Args...)...)
 	if err != nil {
-		return nil, errors.New("transforming file with optipng: " + err.Error())
+		workspace.Remove(outputPath)
+		return nil, &ToolError{Tool: "optipng", Err: err}
 	}
 
-	fileStat, err := os.Stat(outputPath)
+	size, err := workspace.Track(outputPath)
 	if err != nil {
 		return nil, err
 	}
@@ -35,6 +40,6 @@ func (o *OptipngOptimizer) Optimize(ctx context.Context, sourcePath string, hidp
 		Optimizer: Name("optipng"),
 		Path:      outputPath,
 		MimeType:  "image/png",
-		Size:      fileStat.Size(),
+		Size:      size,
 	}, nil
 }
@@ -2,73 +2,295 @@ package optimizer
 
 import (
 	"context"
+	"errors"
 	"log"
-	"sort"
+	"runtime"
+	"sync"
+	"time"
 )
 
+type Priority int
+
+const (
+	// Background work such as cache warming, run only when no interactive
+	// work is waiting.
+	PriorityBackground Priority = iota
+	PriorityInteractive
+)
+
+// ErrQueueFull is returned when the pool cannot accept more work.
+var ErrQueueFull = errors.New("task queue is full")
+
 type Task struct {
 	OriginalImage *ImageDescription
 	Optimizers    []ImageOptimizer
-	Hidpi         bool
+	Dpr           float64
+	Priority      Priority
+	// Quality values of the types accepted by the client.
+	TypePreferences map[string]float64
+	ByteBudget      ByteBudget
 }
 
+// TaskPool runs the optimizers of the tasks on a fixed number of workers.
+// Each optimizer of a task is queued as a separate job, tasks that do not fit
+// into the queue of their priority are rejected with ErrQueueFull.
 type TaskPool struct {
-	ScoringFunc func([]*ImageDescription, []error) (*ImageDescription, error)
+	ScoringFunc ScoringFunc
+	// Maximum time a single optimizer is allowed to run.
+	OptimizerTimeout time.Duration
+	// Time before the deadline of the caller at which the unfinished
+	// optimizers are cancelled and the best result collected so far is used.
+	DeadlineMargin time.Duration
+
+	workers   int
+	queueSize int
+
+	start sync.Once
+	// Held by the running jobs and borrowed for additional work of a job.
+	slots  chan struct{}
+	mu     sync.Mutex
+	queued map[Priority]int
+	queues map[Priority]chan *job
 }
 
-func NewTaskPool() *TaskPool {
+func NewTaskPool(workers, queueSize int) *TaskPool {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
 	return &TaskPool{
-		ScoringFunc: func(descriptions []*ImageDescription, errors []error) (*ImageDescription, error) {
-			if len(errors) > 0 {
-				log.Println(errors)
-			}
-			sort.Sort(bySize(descriptions))
-			for _, desc := range descriptions {
-				log.Printf("optimizer=%s size=%d type=%s", desc.Optimizer, desc.Size, desc.MimeType)
-			}
-			return descriptions[0], nil
+		ScoringFunc: NewScoringFunc(),
+		workers:     workers,
+		queueSize:   queueSize,
+		slots:       make(chan struct{}, workers),
+		queued:      make(map[Priority]int),
+		queues: map[Priority]chan *job{
+			PriorityInteractive: make(chan *job, queueSize),
+			PriorityBackground:  make(chan *job, queueSize),
 		},
 	}
 }
 
+// Result is the image chosen for a task and the failures of the optimizers
+// that did not produce an image.
+type Result struct {
+	Image    *ImageDescription
+	Failures []*OptimizerError
+	// Set when the task has a byte budget no image fits into.
+	BudgetExceeded bool
+	// Qualities tried by the quality searches of all the optimizers.
+	Probes []Probe
+}
+
 type result struct {
-	desc *ImageDescription
-	err  error
+	index int
+	desc  *ImageDescription
+	err   error
 }
 
-func (p *TaskPool) Do(ctx context.Context, task *Task) (*ImageDescription, error) {
-	done := make(chan result, len(task.Optimizers))
-	for _, imageOptimizer := range task.Optimizers {
-		go func(opt ImageOptimizer) {
-			desc, err := opt.Optimize(ctx, task.OriginalImage.Path, task.Hidpi)
-			done <- result{
-				desc: desc,
-				err:  err,
+type job struct {
+	ctx       context.Context
+	task      *Task
+	index     int
+	optimizer ImageOptimizer
+	timeout   time.Duration
+	done      chan<- result
+}
+
+func (p *TaskPool) worker() {
+	interactive := p.queues[PriorityInteractive]
+	background := p.queues[PriorityBackground]
+	for {
+		var j *job
+		select {
+		case j = <-interactive:
+		default:
+			select {
+			case j = <-interactive:
+			case j = <-background:
 			}
-		}(imageOptimizer)
+		}
+		p.dequeued(j.task.Priority)
+		p.slots <- struct{}{}
+		j.run()
+		<-p.slots
+	}
+}
+
+func (j *job) run() {
+	if err := j.ctx.Err(); err != nil {
+		j.done <- result{index: j.index, err: &TimeoutError{Err: err}}
+		return
+	}
+	ctx := j.ctx
+	if j.task.ByteBudget.Bytes > 0 {
+		ctx = withByteBudget(ctx, j.task.ByteBudget)
+	}
+	if j.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, j.timeout)
+		defer cancel()
+	}
+	desc, err := j.optimizer.Optimize(ctx, j.task.OriginalImage, j.task.Dpr)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = &TimeoutError{Err: err}
+	}
+	j.done <- result{
+		index: j.index,
+		desc:  desc,
+		err:   err,
+	}
+}
+
+// reserve claims space in the queue for all jobs of the task.
+func (p *TaskPool) reserve(priority Priority, jobs int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.queued[priority]+jobs > p.queueSize {
+		return false
+	}
+	p.queued[priority] += jobs
+	return true
+}
+
+func (p *TaskPool) dequeued(priority Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.queued[priority]--
+}
+
+// borrow claims up to n of the workers that are idle and returns the number
+// claimed. A nil pool has no workers to borrow.
+func (p *TaskPool) borrow(n int) int {
+	if p == nil {
+		return 0
+	}
+	for i := 0; i < n; i++ {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			return i
+		}
+	}
+	return n
+}
+
+func (p *TaskPool) release(n int) {
+	for i := 0; i < n; i++ {
+		<-p.slots
+	}
+}
+
+type poolKey struct{}
+
+func poolFrom(ctx context.Context) *TaskPool {
+	pool, _ := ctx.Value(poolKey{}).(*TaskPool)
+	return pool
+}
+
+// Do runs the optimizers of the task and chooses the best result. When the
+// context ends before all optimizers are done the remaining ones are
+// cancelled, reported as timed out, and the best of the results collected so
+// far is chosen.
+func (p *TaskPool) Do(ctx context.Context, task *Task) (*Result, error) {
+	p.start.Do(func() {
+		for i := 0; i < p.workers; i++ {
+			go p.worker()
+		}
+	})
+
+	queue, ok := p.queues[task.Priority]
+	if !ok {
+		return nil, errors.New("unknown task priority")
+	}
+	if !p.reserve(task.Priority, len(task.Optimizers)) {
+		return nil, ErrQueueFull
+	}
+
+	trace := &probeTrace{}
+	jobCtx := context.WithValue(context.WithValue(ctx, poolKey{}, p), probeTraceKey{}, trace)
+	jobCtx, cancel := context.WithCancel(context.WithValue(jobCtx, sourceHashKey{}, &sourceHash{}))
+	defer cancel()
+
+	done := make(chan result, len(task.Optimizers))
+	for i, imageOptimizer := range task.Optimizers {
+		queue <- &job{
+			ctx:       jobCtx,
+			task:      task,
+			index:     i,
+			optimizer: imageOptimizer,
+			timeout:   p.OptimizerTimeout,
+			done:      done,
+		}
+	}
+
+	var deadlineNear <-chan time.Time
+	if deadline, ok := ctx.Deadline(); ok && p.DeadlineMargin > 0 {
+		timer := time.NewTimer(time.Until(deadline) - p.DeadlineMargin)
+		defer timer.Stop()
+		deadlineNear = timer.C
 	}
 
 	imageDescriptions := make([]*ImageDescription, 0, len(task.Optimizers)+1)
 	imageDescriptions = append(imageDescriptions, task.OriginalImage)
-	errors := make([]error, 0, len(task.Optimizers))
+	failures := make([]*OptimizerError, 0)
+	finished := make([]bool, len(task.Optimizers))
 	var numDone int
 
 loop:
 	for {
 		select {
 		case <-ctx.Done():
-			return nil, ctx.Err()
+			log.Printf("Context done, using results of %d/%d optimizers err=%s", numDone, len(task.Optimizers), ctx.Err())
+			break loop
+		case <-deadlineNear:
+			log.Printf("Deadline near, using results of %d/%d optimizers", numDone, len(task.Optimizers))
+			break loop
 		case result := <-done:
 			if result.err != nil {
-				errors = append(errors, result.err)
+				failures = append(failures, &OptimizerError{
+					Optimizer: optimizerName(task.Optimizers[result.index]),
+					Err:       result.err,
+				})
 			} else if result.desc != nil {
 				imageDescriptions = append(imageDescriptions, result.desc)
 			}
+			finished[result.index] = true
 			numDone++
 			if numDone == len(task.Optimizers) {
 				break loop
 			}
 		}
 	}
-	return p.ScoringFunc(imageDescriptions, errors)
+	cancel()
+
+	for i, imageOptimizer := range task.Optimizers {
+		if !finished[i] {
+			failures = append(failures, &OptimizerError{
+				Optimizer: optimizerName(imageOptimizer),
+				Err:       &TimeoutError{Err: errors.New("not finished before the deadline")},
+			})
+		}
+	}
+	errs := make([]error, 0, len(failures))
+	for _, failure := range failures {
+		optimizerFailures.Add(ErrorKind(failure), 1)
+		errs = append(errs, failure)
+	}
+
+	chosen, err := p.ScoringFunc(task, imageDescriptions, errs)
+	workspace := workspaceFrom(ctx)
+	for _, desc := range imageDescriptions {
+		if desc != chosen && desc != task.OriginalImage {
+			workspace.Discard(desc)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Result{
+		Image:          chosen,
+		Failures:       failures,
+		BudgetExceeded: task.ByteBudget.Bytes > 0 && chosen.Size > task.ByteBudget.Bytes,
+		Probes:         trace.list(),
+	}, nil
 }
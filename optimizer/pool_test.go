@@ -0,0 +1,143 @@
+package optimizer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// funcOptimizer runs the function instead of optimizing.
+type funcOptimizer func(ctx context.Context) (*ImageDescription, error)
+
+func (f funcOptimizer) CanOptimize(mimeType string, acceptedTypes []string) bool {
+	return true
+}
+
+func (f funcOptimizer) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	return f(ctx)
+}
+
+// blockPool occupies the only worker of the pool until the returned function
+// is called.
+func blockPool(ctx context.Context, pool *TaskPool) func() {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blocker := funcOptimizer(func(ctx context.Context) (*ImageDescription, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pool.Do(ctx, testTask(PriorityInteractive, blocker))
+	}()
+	<-started
+	return func() {
+		close(release)
+		<-done
+	}
+}
+
+func testTask(priority Priority, optimizers ...ImageOptimizer) *Task {
+	return &Task{
+		OriginalImage: describeData("original", []byte("image"), "image/png"),
+		Optimizers:    optimizers,
+		Priority:      priority,
+	}
+}
+
+// waitQueued waits until the number of jobs waiting with the priority is n.
+func waitQueued(t *testing.T, pool *TaskPool, priority Priority, n int) {
+	for i := 0; i < 1000; i++ {
+		pool.mu.Lock()
+		queued := pool.queued[priority]
+		pool.mu.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d jobs of priority %d never queued", n, priority)
+}
+
+func TestTaskPoolQueueFull(t *testing.T) {
+	ctx, cleanup := testWorkspace(t)
+	defer cleanup()
+	pool := NewTaskPool(1, 2)
+	release := blockPool(ctx, pool)
+
+	noop := funcOptimizer(func(ctx context.Context) (*ImageDescription, error) {
+		return nil, nil
+	})
+	if _, err := pool.Do(ctx, testTask(PriorityInteractive, noop, noop, noop)); err != ErrQueueFull {
+		t.Errorf("task larger than the queue: got %v, want ErrQueueFull", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := pool.Do(ctx, testTask(PriorityInteractive, noop, noop)); err != nil {
+			t.Errorf("queued task: %v", err)
+		}
+	}()
+	waitQueued(t, pool, PriorityInteractive, 2)
+
+	if _, err := pool.Do(ctx, testTask(PriorityInteractive, noop)); err != ErrQueueFull {
+		t.Errorf("task not fitting into the rest of the queue: got %v, want ErrQueueFull", err)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := pool.Do(ctx, testTask(PriorityBackground, noop)); err != nil {
+			t.Errorf("background task: %v", err)
+		}
+	}()
+	waitQueued(t, pool, PriorityBackground, 1)
+
+	release()
+	wg.Wait()
+	waitQueued(t, pool, PriorityInteractive, 0)
+	if _, err := pool.Do(ctx, testTask(PriorityInteractive, noop, noop)); err != nil {
+		t.Errorf("task after the queue drained: %v", err)
+	}
+}
+
+func TestTaskPoolPriority(t *testing.T) {
+	ctx, cleanup := testWorkspace(t)
+	defer cleanup()
+	pool := NewTaskPool(1, 4)
+	release := blockPool(ctx, pool)
+
+	var mu sync.Mutex
+	var order []Priority
+	recorder := func(priority Priority) ImageOptimizer {
+		return funcOptimizer(func(ctx context.Context) (*ImageDescription, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, priority)
+			return nil, nil
+		})
+	}
+
+	var wg sync.WaitGroup
+	for _, priority := range []Priority{PriorityBackground, PriorityInteractive} {
+		wg.Add(1)
+		go func(priority Priority) {
+			defer wg.Done()
+			pool.Do(ctx, testTask(priority, recorder(priority), recorder(priority)))
+		}(priority)
+		waitQueued(t, pool, priority, 2)
+	}
+
+	release()
+	wg.Wait()
+	want := []Priority{PriorityInteractive, PriorityInteractive, PriorityBackground, PriorityBackground}
+	for i := range want {
+		if i >= len(order) || order[i] != want[i] {
+			t.Fatalf("got order %v, want %v", order, want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package optimizer
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"os"
+	"sync"
+)
+
+// QualityKey identifies the quality search of an optimizer for a source.
+// Records of searches with another metric or threshold do not match, so
+// changing them searches the qualities again.
+type QualityKey struct {
+	// Hash of the pixels of the source image.
+	Hash      string  `json:"hash"`
+	Optimizer string  `json:"optimizer"`
+	Dpr       float64 `json:"dpr"`
+	// Metric and threshold the quality was chosen with.
+	Metric string `json:"metric"`
+}
+
+// QualityRecord is the result of a quality search.
+type QualityRecord struct {
+	Quality int     `json:"quality"`
+	Score   float64 `json:"score"`
+}
+
+// QualityStore remembers the qualities chosen by quality searches, so a
+// search for the same source only has to verify the remembered quality.
+type QualityStore interface {
+	Get(key QualityKey) (QualityRecord, bool)
+	Put(key QualityKey, record QualityRecord) error
+}
+
+type qualityEntry struct {
+	QualityKey
+	QualityRecord
+}
+
+var _ QualityStore = &FileQualityStore{}
+
+// FileQualityStore keeps the records in memory and appends them to a file
+// from which they are loaded on start.
+type FileQualityStore struct {
+	mu      sync.Mutex
+	file    *os.File
+	records map[QualityKey]QualityRecord
+}
+
+func NewFileQualityStore(path string) (*FileQualityStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make(map[QualityKey]QualityRecord)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry qualityEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Skip entries cut short by a crash.
+			continue
+		}
+		records[entry.QualityKey] = entry.QualityRecord
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &FileQualityStore{
+		file:    file,
+		records: records,
+	}, nil
+}
+
+func (s *FileQualityStore) Get(key QualityKey) (QualityRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[key]
+	return record, ok
+}
+
+func (s *FileQualityStore) Put(key QualityKey, record QualityRecord) error {
+	line, err := json.Marshal(qualityEntry{key, record})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[key] = record
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+func (s *FileQualityStore) Close() error {
+	return s.file.Close()
+}
+
+type sourceHashKey struct{}
+
+// sourceHash hashes the source of a task once for all of its optimizers.
+type sourceHash struct {
+	once sync.Once
+	hash string
+}
+
+func (h *sourceHash) get(img image.Image) string {
+	h.once.Do(func() {
+		h.hash = pixelHash(img)
+	})
+	return h.hash
+}
+
+// sourceHashFrom returns the hash shared by the optimizers of the task, or a
+// new one outside of a task.
+func sourceHashFrom(ctx context.Context) *sourceHash {
+	if hash, ok := ctx.Value(sourceHashKey{}).(*sourceHash); ok {
+		return hash
+	}
+	return &sourceHash{}
+}
+
+// pixelHash hashes the dimensions and the colors of the pixels of the image,
+// so copies of an image that only differ in metadata or in the lossless
+// encoding have the same hash.
+func pixelHash(img image.Image) string {
+	hash := sha256.New()
+	bounds := img.Bounds()
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[:4], uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(buf[4:], uint32(bounds.Dy()))
+	hash.Write(buf[:])
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			binary.BigEndian.PutUint16(buf[0:], uint16(r))
+			binary.BigEndian.PutUint16(buf[2:], uint16(g))
+			binary.BigEndian.PutUint16(buf[4:], uint16(b))
+			binary.BigEndian.PutUint16(buf[6:], uint16(a))
+			hash.Write(buf[:])
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,88 @@
+package optimizer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type memoryQualityStore map[QualityKey]QualityRecord
+
+func (s memoryQualityStore) Get(key QualityKey) (QualityRecord, bool) {
+	record, ok := s[key]
+	return record, ok
+}
+
+func (s memoryQualityStore) Put(key QualityKey, record QualityRecord) error {
+	s[key] = record
+	return nil
+}
+
+func TestQualityStoreKeyedByMetric(t *testing.T) {
+	ctx, cleanup := testWorkspace(t)
+	defer cleanup()
+
+	executor := NewFakeExecutor()
+	executor.Handle("cjpeg", fakeCjpeg)
+	source := testJpeg(t, 95)
+	store := memoryQualityStore{}
+	optimize := func(metric Metric) {
+		optimizer := NewMozjpegLossyOptimizer(metric, MozjpegSearchSpace{}, executor).(*AutomaticOptimizer)
+		optimizer.Store = store
+		if _, err := optimizer.Optimize(ctx, source, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	optimize(&SsimMetric{MinScore: 0.99})
+	searched := len(executor.Commands())
+	optimize(&SsimMetric{MinScore: 0.99})
+	if verified := len(executor.Commands()) - searched; verified != 1 {
+		t.Errorf("got %d encoder runs with a remembered quality, want 1", verified)
+	}
+	optimize(&SsimMetric{MinScore: 0.95})
+
+	if len(store) != 2 {
+		t.Fatalf("got %d records, want one for each threshold", len(store))
+	}
+	qualities := make(map[string]int)
+	for key, record := range store {
+		qualities[key.Metric] = record.Quality
+	}
+	if qualities["ssim:threshold=0.95"] >= qualities["ssim:threshold=0.99"] {
+		t.Errorf("got qualities %v, want a lower quality for the lower threshold", qualities)
+	}
+}
+
+func TestFileQualityStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imageoptimizer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "qualities")
+
+	key := QualityKey{Hash: "abc", Optimizer: "cwebp-lossy[image/png]", Dpr: 2, Metric: "ssim:threshold=0.99"}
+	store, err := NewFileQualityStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(key, QualityRecord{Quality: 80, Score: 0.991}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = NewFileQualityStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if record, ok := store.Get(key); !ok || record.Quality != 80 {
+		t.Errorf("got %v, %t after reopening", record, ok)
+	}
+	key.Metric = "ssim:threshold=0.98"
+	if _, ok := store.Get(key); ok {
+		t.Error("record found for another threshold")
+	}
+}
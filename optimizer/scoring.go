@@ -0,0 +1,162 @@
+package optimizer
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ScoringFunc chooses the image served for the task from the original image
+// and the images produced by the optimizers.
+type ScoringFunc func(task *Task, descriptions []*ImageDescription, errors []error) (*ImageDescription, error)
+
+// ScoringPolicy adjusts the score of an image, the image with the lowest score
+// is chosen. Scores start at the size of the image, a policy returning
+// +Inf disqualifies the image.
+type ScoringPolicy interface {
+	Score(task *Task, desc *ImageDescription, score float64) float64
+}
+
+// NewScoringFunc returns a scoring function applying the policies in order.
+// Without policies the smallest image is chosen. The original image is chosen
+// when all the optimized images are disqualified. With a byte budget the
+// images fitting into it are preferred.
+func NewScoringFunc(policies ...ScoringPolicy) ScoringFunc {
+	return func(task *Task, descriptions []*ImageDescription, errors []error) (*ImageDescription, error) {
+		if len(errors) > 0 {
+			log.Println(errors)
+		}
+		sort.Sort(bySize(descriptions))
+		chosen := task.OriginalImage
+		bestScore := math.Inf(1)
+		bestFits := false
+		for _, desc := range descriptions {
+			score := float64(desc.Size)
+			for _, policy := range policies {
+				score = policy.Score(task, desc, score)
+			}
+			log.Printf("optimizer=%s size=%d type=%s score=%.0f", desc.Optimizer, desc.Size, desc.MimeType, score)
+			if math.IsInf(score, 1) {
+				continue
+			}
+			fits := task.ByteBudget.Bytes <= 0 || desc.Size <= task.ByteBudget.Bytes
+			if (fits && !bestFits) || (fits == bestFits && score < bestScore) {
+				chosen = desc
+				bestScore = score
+				bestFits = fits
+			}
+		}
+		return chosen, nil
+	}
+}
+
+// MinSavingPolicy disqualifies optimized images that are not smaller than the
+// original by at least the given number of bytes and fraction of its size.
+type MinSavingPolicy struct {
+	Bytes int64
+	Ratio float64
+}
+
+func (p *MinSavingPolicy) Score(task *Task, desc *ImageDescription, score float64) float64 {
+	if desc == task.OriginalImage {
+		return score
+	}
+	saving := task.OriginalImage.Size - desc.Size
+	if saving < p.Bytes || float64(saving) < p.Ratio*float64(task.OriginalImage.Size) {
+		return math.Inf(1)
+	}
+	return score
+}
+
+// AcceptPolicy favours the formats the client prefers by dividing the score
+// by the quality value of the type in the Accept header.
+type AcceptPolicy struct{}
+
+func (p *AcceptPolicy) Score(task *Task, desc *ImageDescription, score float64) float64 {
+	q, ok := acceptQuality(task.TypePreferences, desc.MimeType)
+	if !ok {
+		return score
+	}
+	if q <= 0 {
+		return math.Inf(1)
+	}
+	return score / q
+}
+
+func acceptQuality(preferences map[string]float64, mimeType string) (float64, bool) {
+	candidates := []string{mimeType, "*/*"}
+	if i := strings.Index(mimeType, "/"); i >= 0 {
+		candidates = []string{mimeType, mimeType[:i] + "/*", "*/*"}
+	}
+	for _, candidate := range candidates {
+		if q, ok := preferences[candidate]; ok {
+			return q, true
+		}
+	}
+	return 0, false
+}
+
+// DecodeCostPolicy penalizes formats that are expensive to decode. The score
+// of an image is increased by the fraction given for its type.
+type DecodeCostPolicy struct {
+	Penalties map[string]float64
+}
+
+func (p *DecodeCostPolicy) Score(task *Task, desc *ImageDescription, score float64) float64 {
+	return score * (1 + p.Penalties[desc.MimeType])
+}
+
+// ParseScoringPolicies parses policies in the form
+// "saving:bytes=1024,ratio=0.02;accept;decode:image/webp=0.1".
+func ParseScoringPolicies(spec string) ([]ScoringPolicy, error) {
+	policies := make([]ScoringPolicy, 0)
+	for _, policySpec := range strings.Split(spec, ";") {
+		policySpec = strings.TrimSpace(policySpec)
+		if policySpec == "" {
+			continue
+		}
+		parts := strings.SplitN(policySpec, ":", 2)
+		params := make(map[string]float64)
+		if len(parts) == 2 {
+			for _, param := range strings.Split(parts[1], ",") {
+				kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+				if len(kv) != 2 {
+					return nil, errors.New("invalid parameter of " + parts[0] + ": " + param)
+				}
+				value, err := strconv.ParseFloat(kv[1], 64)
+				if err != nil {
+					return nil, errors.New("invalid parameter of " + parts[0] + ": " + err.Error())
+				}
+				params[kv[0]] = value
+			}
+		}
+		switch parts[0] {
+		case "saving":
+			policy := &MinSavingPolicy{}
+			for name, value := range params {
+				switch name {
+				case "bytes":
+					policy.Bytes = int64(value)
+				case "ratio":
+					policy.Ratio = value
+				default:
+					return nil, errors.New("unknown parameter of saving: " + name)
+				}
+			}
+			policies = append(policies, policy)
+		case "accept":
+			if len(params) > 0 {
+				return nil, errors.New("accept policy has no parameters")
+			}
+			policies = append(policies, &AcceptPolicy{})
+		case "decode":
+			policies = append(policies, &DecodeCostPolicy{Penalties: params})
+		default:
+			return nil, errors.New("unknown scoring policy " + parts[0])
+		}
+	}
+	return policies, nil
+}
@@ -0,0 +1,93 @@
+package optimizer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScoringFunc(t *testing.T) {
+	original := &ImageDescription{Optimizer: "original", MimeType: "image/jpeg", Size: 1000}
+	webp := &ImageDescription{Optimizer: "webp", MimeType: "image/webp", Size: 600}
+	jpeg := &ImageDescription{Optimizer: "jpeg", MimeType: "image/jpeg", Size: 700}
+	png := &ImageDescription{Optimizer: "png", MimeType: "image/png", Size: 1200}
+
+	tests := []struct {
+		name        string
+		policies    []ScoringPolicy
+		preferences map[string]float64
+		budget      int64
+		want        *ImageDescription
+	}{
+		{name: "smallest", want: webp},
+		{name: "saving met", policies: []ScoringPolicy{&MinSavingPolicy{Bytes: 350, Ratio: 0.35}}, want: webp},
+		{name: "saving bytes not met", policies: []ScoringPolicy{&MinSavingPolicy{Bytes: 500}}, want: original},
+		{name: "saving ratio not met", policies: []ScoringPolicy{&MinSavingPolicy{Ratio: 0.5}}, want: original},
+		{
+			name:        "accept preference",
+			policies:    []ScoringPolicy{&AcceptPolicy{}},
+			preferences: map[string]float64{"image/webp": 0.5, "image/*": 1},
+			want:        jpeg,
+		},
+		{
+			name:        "accept wildcard",
+			policies:    []ScoringPolicy{&AcceptPolicy{}},
+			preferences: map[string]float64{"image/*": 0.5, "*/*": 0.1},
+			want:        webp,
+		},
+		{
+			name:        "accept refused",
+			policies:    []ScoringPolicy{&AcceptPolicy{}},
+			preferences: map[string]float64{"image/webp": 0},
+			want:        jpeg,
+		},
+		{
+			name:        "all refused",
+			policies:    []ScoringPolicy{&AcceptPolicy{}},
+			preferences: map[string]float64{"image/*": 0},
+			want:        original,
+		},
+		{name: "decode cost", policies: []ScoringPolicy{&DecodeCostPolicy{Penalties: map[string]float64{"image/webp": 0.2}}}, want: jpeg},
+		{
+			name:        "budget preferred",
+			policies:    []ScoringPolicy{&AcceptPolicy{}},
+			preferences: map[string]float64{"image/webp": 0.5, "image/*": 1},
+			budget:      650,
+			want:        webp,
+		},
+		{name: "no image fits the budget", budget: 100, want: webp},
+	}
+	for _, test := range tests {
+		task := &Task{
+			OriginalImage:   original,
+			TypePreferences: test.preferences,
+			ByteBudget:      ByteBudget{Bytes: test.budget},
+		}
+		chosen, err := NewScoringFunc(test.policies...)(task, []*ImageDescription{original, png, jpeg, webp}, nil)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if chosen != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, chosen.Optimizer, test.want.Optimizer)
+		}
+	}
+}
+
+func TestParseScoringPolicies(t *testing.T) {
+	policies, err := ParseScoringPolicies("saving:bytes=1024,ratio=0.02; accept;decode:image/webp=0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ScoringPolicy{
+		&MinSavingPolicy{Bytes: 1024, Ratio: 0.02},
+		&AcceptPolicy{},
+		&DecodeCostPolicy{Penalties: map[string]float64{"image/webp": 0.1}},
+	}
+	if !reflect.DeepEqual(policies, want) {
+		t.Errorf("got %+v, want %+v", policies, want)
+	}
+
+	for _, spec := range []string{"fastest", "saving:percent=2", "saving:bytes", "saving:bytes=x", "accept:q=1"} {
+		if _, err := ParseScoringPolicies(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
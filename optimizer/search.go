@@ -0,0 +1,356 @@
+package optimizer
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Probe is a quality tried during a quality search.
+type Probe struct {
+	Quality int     `json:"quality"`
+	Score   float64 `json:"score"`
+	Size    int64   `json:"size"`
+	// Optimizer that tried the quality.
+	Optimizer string `json:"optimizer,omitempty"`
+	// Set when the probe reached the goal of the search, the threshold of
+	// the metric or, with a byte budget, a size over the budget.
+	Reached bool `json:"reached"`
+	// Set when the quality was tried to verify the neighbourhood of the
+	// boundary of a search with non-monotonic probes.
+	Neighbour bool `json:"neighbour,omitempty"`
+}
+
+// probeTrace collects the probes of all the quality searches of a task.
+type probeTrace struct {
+	mu     sync.Mutex
+	probes []Probe
+}
+
+type probeTraceKey struct{}
+
+func probeTraceFrom(ctx context.Context) *probeTrace {
+	trace, _ := ctx.Value(probeTraceKey{}).(*probeTrace)
+	return trace
+}
+
+func (t *probeTrace) add(probe Probe) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.probes = append(t.probes, probe)
+}
+
+func (t *probeTrace) list() []Probe {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Probe(nil), t.probes...)
+}
+
+// monotonic reports whether higher qualities of the probes have higher scores
+// and sizes, as the quality searches assume.
+func monotonic(probes []Probe) bool {
+	sorted := append([]Probe(nil), probes...)
+	sort.Sort(byQuality(sorted))
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Quality == sorted[i-1].Quality {
+			continue
+		}
+		if sorted[i].Score < sorted[i-1].Score || sorted[i].Size < sorted[i-1].Size {
+			return false
+		}
+	}
+	return true
+}
+
+type byQuality []Probe
+
+func (s byQuality) Len() int {
+	return len(s)
+}
+
+func (s byQuality) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s byQuality) Less(i, j int) bool {
+	return s[i].Quality < s[j].Quality
+}
+
+// neighbours returns the qualities within distance of the boundary, the lowest
+// quality of the probes that reached the threshold, which were not tried yet
+// and lie in the range min..max. Without such a probe the boundary is just
+// above max.
+func neighbours(probes []Probe, distance, min, max int) []int {
+	boundary := max + 1
+	tried := make([]int, 0, len(probes))
+	for _, probe := range probes {
+		tried = append(tried, probe.Quality)
+		if probe.Reached && probe.Quality < boundary {
+			boundary = probe.Quality
+		}
+	}
+
+	var qualities []int
+	for quality := boundary - distance; quality <= boundary+distance; quality++ {
+		if quality >= min && quality <= max && !containsQuality(tried, quality) {
+			qualities = append(qualities, quality)
+		}
+	}
+	return qualities
+}
+
+// SearchStrategy chooses the qualities tried while searching for the lowest
+// quality with a score of at least the threshold.
+type SearchStrategy interface {
+	// Next returns the next quality to try given the probes so far, or false
+	// when the search is done.
+	Next(probes []Probe, threshold float64) (int, bool)
+}
+
+// ParallelSearchStrategy is implemented by strategies that can choose several
+// qualities to be tried at the same time.
+type ParallelSearchStrategy interface {
+	SearchStrategy
+	// NextN returns up to n distinct qualities to try given the probes so
+	// far, or none when the search is done.
+	NextN(probes []Probe, threshold float64, n int) []int
+}
+
+// BoundedSearchStrategy is implemented by strategies searching a range of
+// qualities whose highest quality can be lowered for a single search.
+type BoundedSearchStrategy interface {
+	SearchStrategy
+	Range() (min int, max int)
+	WithMax(max int) SearchStrategy
+}
+
+// strategyRange returns the range of qualities searched by the strategy,
+// 0..max for strategies without a range.
+func strategyRange(strategy SearchStrategy, max int) (int, int) {
+	if boundedStrategy, ok := strategy.(BoundedSearchStrategy); ok {
+		return boundedStrategy.Range()
+	}
+	return 0, max
+}
+
+// limitStrategy lowers the highest quality tried by the strategy when it
+// supports it.
+func limitStrategy(strategy SearchStrategy, max int) SearchStrategy {
+	if boundedStrategy, ok := strategy.(BoundedSearchStrategy); ok {
+		return boundedStrategy.WithMax(max)
+	}
+	return strategy
+}
+
+// limitRange lowers the range min..max to end at limit.
+func limitRange(min, max, limit int) (int, int) {
+	if limit < max {
+		max = limit
+	}
+	if min > max {
+		min = max
+	}
+	return min, max
+}
+
+var DefaultSearchStrategy SearchStrategy = &InterpolationSearch{
+	Min:       40,
+	Max:       95,
+	Tolerance: 0.0005,
+}
+
+// DefaultBudgetStrategy searches the whole range of qualities, as the budget
+// may only be met at low qualities.
+var DefaultBudgetStrategy SearchStrategy = &InterpolationSearch{
+	Min: 0,
+	Max: 100,
+}
+
+// searchBounds returns the range of qualities that remain to be searched. The
+// search is done early when a probe scored within tolerance of the threshold.
+func searchBounds(probes []Probe, threshold float64, min, max int, tolerance float64) (lo int, hi int, done bool) {
+	lo, hi = min, max
+	for _, probe := range probes {
+		if probe.Score < threshold {
+			if probe.Quality+1 > lo {
+				lo = probe.Quality + 1
+			}
+		} else {
+			if probe.Quality-1 < hi {
+				hi = probe.Quality - 1
+			}
+			if probe.Score-threshold <= tolerance {
+				done = true
+			}
+		}
+	}
+	return lo, hi, done || lo > hi
+}
+
+// BinarySearch halves the range of qualities with every probe.
+type BinarySearch struct {
+	Min int
+	Max int
+	// Distance from the threshold at which a score is good enough to stop.
+	Tolerance float64
+}
+
+func (s *BinarySearch) Next(probes []Probe, threshold float64) (int, bool) {
+	lo, hi, done := searchBounds(probes, threshold, s.Min, s.Max, s.Tolerance)
+	if done {
+		return 0, false
+	}
+	return (lo + hi) / 2, true
+}
+
+func (s *BinarySearch) Range() (int, int) {
+	return s.Min, s.Max
+}
+
+func (s *BinarySearch) WithMax(max int) SearchStrategy {
+	limited := *s
+	limited.Min, limited.Max = limitRange(s.Min, s.Max, max)
+	return &limited
+}
+
+// NextN divides the range of qualities into n+1 parts, a k-ary search.
+func (s *BinarySearch) NextN(probes []Probe, threshold float64, n int) []int {
+	lo, hi, done := searchBounds(probes, threshold, s.Min, s.Max, s.Tolerance)
+	if done {
+		return nil
+	}
+	return splitRange(nil, lo, hi, n)
+}
+
+// splitRange adds the qualities dividing lo..hi into n+1 parts to the
+// qualities, skipping those already included.
+func splitRange(qualities []int, lo, hi, n int) []int {
+	for i := 1; i <= n; i++ {
+		quality := lo + i*(hi-lo)/(n+1)
+		if !containsQuality(qualities, quality) {
+			qualities = append(qualities, quality)
+		}
+	}
+	return qualities
+}
+
+func containsQuality(qualities []int, quality int) bool {
+	for _, q := range qualities {
+		if q == quality {
+			return true
+		}
+	}
+	return false
+}
+
+// InterpolationSearch estimates the quality reaching the threshold from the
+// scores of the closest probes below and above it, assuming the score changes
+// linearly between them. Until a probe on both sides exists it halves the
+// range.
+type InterpolationSearch struct {
+	Min int
+	Max int
+	// Distance from the threshold at which a score is good enough to stop.
+	Tolerance float64
+}
+
+func (s *InterpolationSearch) Next(probes []Probe, threshold float64) (int, bool) {
+	lo, hi, done := searchBounds(probes, threshold, s.Min, s.Max, s.Tolerance)
+	if done {
+		return 0, false
+	}
+
+	var below, above *Probe
+	for i := range probes {
+		probe := &probes[i]
+		if probe.Score < threshold {
+			if below == nil || probe.Quality > below.Quality {
+				below = probe
+			}
+		} else if above == nil || probe.Quality < above.Quality {
+			above = probe
+		}
+	}
+	if below == nil || above == nil || above.Score <= below.Score {
+		return (lo + hi) / 2, true
+	}
+
+	estimate := float64(below.Quality) + (threshold-below.Score)*float64(above.Quality-below.Quality)/(above.Score-below.Score)
+	quality := int(math.Ceil(estimate))
+	if quality < lo {
+		quality = lo
+	} else if quality > hi {
+		quality = hi
+	}
+	return quality, true
+}
+
+func (s *InterpolationSearch) Range() (int, int) {
+	return s.Min, s.Max
+}
+
+func (s *InterpolationSearch) WithMax(max int) SearchStrategy {
+	limited := *s
+	limited.Min, limited.Max = limitRange(s.Min, s.Max, max)
+	return &limited
+}
+
+// NextN tries the estimated quality and divides the range of qualities with
+// the rest.
+func (s *InterpolationSearch) NextN(probes []Probe, threshold float64, n int) []int {
+	quality, ok := s.Next(probes, threshold)
+	if !ok {
+		return nil
+	}
+	lo, hi, _ := searchBounds(probes, threshold, s.Min, s.Max, s.Tolerance)
+	return splitRange([]int{quality}, lo, hi, n-1)
+}
+
+// ParseSearchStrategy parses a strategy in the form
+// "interpolation:min=40,max=95,tolerance=0.0005" or "binary:min=0,max=100".
+// Parameters that are not given default to the range 40..95 and a tolerance
+// of 0.0005.
+func ParseSearchStrategy(spec string) (SearchStrategy, error) {
+	parts := strings.SplitN(strings.TrimSpace(spec), ":", 2)
+	min, max, tolerance := 40, 95, 0.0005
+	if len(parts) == 2 {
+		for _, param := range strings.Split(parts[1], ",") {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 {
+				return nil, errors.New("invalid parameter: " + param)
+			}
+			var err error
+			switch kv[0] {
+			case "min":
+				min, err = strconv.Atoi(kv[1])
+			case "max":
+				max, err = strconv.Atoi(kv[1])
+			case "tolerance":
+				tolerance, err = strconv.ParseFloat(kv[1], 64)
+			default:
+				err = errors.New("unknown parameter " + kv[0])
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if min < 0 || max > 100 || min > max {
+		return nil, errors.New("invalid quality range")
+	}
+
+	switch parts[0] {
+	case "binary":
+		return &BinarySearch{Min: min, Max: max, Tolerance: tolerance}, nil
+	case "interpolation":
+		return &InterpolationSearch{Min: min, Max: max, Tolerance: tolerance}, nil
+	}
+	return nil, errors.New("unknown search strategy " + parts[0])
+}
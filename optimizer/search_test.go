@@ -0,0 +1,197 @@
+package optimizer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNeighbours(t *testing.T) {
+	tests := []struct {
+		name     string
+		probes   []Probe
+		distance int
+		min, max int
+		want     []int
+	}{
+		{
+			name:     "around the boundary",
+			probes:   []Probe{{Quality: 60, Reached: true}, {Quality: 50}, {Quality: 70, Reached: true}},
+			distance: 2,
+			min:      40, max: 95,
+			want: []int{58, 59, 61, 62},
+		},
+		{
+			name:     "boundary at min",
+			probes:   []Probe{{Quality: 40, Reached: true}, {Quality: 67, Reached: true}},
+			distance: 2,
+			min:      40, max: 95,
+			want: []int{41, 42},
+		},
+		{
+			name:     "no probe reached the threshold",
+			probes:   []Probe{{Quality: 95}, {Quality: 67}},
+			distance: 2,
+			min:      40, max: 95,
+			want: []int{94},
+		},
+		{
+			name:     "all tried",
+			probes:   []Probe{{Quality: 40, Reached: true}, {Quality: 41}, {Quality: 42}},
+			distance: 2,
+			min:      40, max: 95,
+		},
+	}
+	for _, test := range tests {
+		got := neighbours(test.probes, test.distance, test.min, test.max)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSearchBounds(t *testing.T) {
+	tests := []struct {
+		name      string
+		probes    []Probe
+		tolerance float64
+		lo, hi    int
+		done      bool
+	}{
+		{name: "no probes", lo: 40, hi: 95},
+		{name: "below", probes: []Probe{{Quality: 50, Score: 0.85}}, lo: 51, hi: 95},
+		{name: "both sides", probes: []Probe{{Quality: 50, Score: 0.85}, {Quality: 80, Score: 0.95}}, lo: 51, hi: 79},
+		{name: "within tolerance", probes: []Probe{{Quality: 70, Score: 0.9005}}, tolerance: 0.001, lo: 40, hi: 69, done: true},
+		{name: "outside tolerance", probes: []Probe{{Quality: 70, Score: 0.902}}, tolerance: 0.001, lo: 40, hi: 69},
+		{name: "exact without tolerance", probes: []Probe{{Quality: 70, Score: 0.9}}, lo: 40, hi: 69, done: true},
+		{name: "adjacent", probes: []Probe{{Quality: 60, Score: 0.85}, {Quality: 61, Score: 0.95}}, lo: 61, hi: 60, done: true},
+	}
+	for _, test := range tests {
+		lo, hi, done := searchBounds(test.probes, 0.9, 40, 95, test.tolerance)
+		if lo != test.lo || hi != test.hi || done != test.done {
+			t.Errorf("%s: got %d..%d done %t, want %d..%d done %t", test.name, lo, hi, done, test.lo, test.hi, test.done)
+		}
+	}
+}
+
+func TestSearchStrategyNext(t *testing.T) {
+	binary := &BinarySearch{Min: 40, Max: 95}
+	interpolation := &InterpolationSearch{Min: 40, Max: 95, Tolerance: 0.0005}
+	tests := []struct {
+		name     string
+		strategy SearchStrategy
+		probes   []Probe
+		want     int
+		ok       bool
+	}{
+		{"binary first", binary, nil, 67, true},
+		{"binary above", binary, []Probe{{Quality: 67, Score: 0.95}}, 53, true},
+		{"binary both sides", binary, []Probe{{Quality: 67, Score: 0.95}, {Quality: 53, Score: 0.85}}, 60, true},
+		{"binary done", binary, []Probe{{Quality: 60, Score: 0.85}, {Quality: 61, Score: 0.95}}, 0, false},
+		{"interpolation first", interpolation, nil, 67, true},
+		{"interpolation one side", interpolation, []Probe{{Quality: 67, Score: 0.95}}, 53, true},
+		{"interpolation estimate", interpolation, []Probe{{Quality: 50, Score: 0.8}, {Quality: 90, Score: 0.98}}, 73, true},
+		{"interpolation clamped", interpolation, []Probe{{Quality: 50, Score: 0.8}, {Quality: 52, Score: 0.98}}, 51, true},
+		{"interpolation within tolerance", interpolation, []Probe{{Quality: 50, Score: 0.8}, {Quality: 70, Score: 0.9004}}, 0, false},
+	}
+	for _, test := range tests {
+		quality, ok := test.strategy.Next(test.probes, 0.9)
+		if quality != test.want || ok != test.ok {
+			t.Errorf("%s: got %d, %t, want %d, %t", test.name, quality, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestSearchStrategyNextN(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy ParallelSearchStrategy
+		probes   []Probe
+		n        int
+		want     []int
+	}{
+		{"binary", &BinarySearch{Min: 40, Max: 95}, nil, 2, []int{58, 76}},
+		{"binary both sides", &BinarySearch{Min: 40, Max: 95}, []Probe{{Quality: 60, Score: 0.85}, {Quality: 70, Score: 0.95}}, 3, []int{63, 65, 67}},
+		{"binary done", &BinarySearch{Min: 40, Max: 95}, []Probe{{Quality: 60, Score: 0.85}, {Quality: 61, Score: 0.95}}, 2, nil},
+		{"interpolation", &InterpolationSearch{Min: 40, Max: 95}, nil, 3, []int{67, 58, 76}},
+		{"interpolation single", &InterpolationSearch{Min: 40, Max: 95}, nil, 1, []int{67}},
+	}
+	for _, test := range tests {
+		got := test.strategy.NextN(test.probes, 0.9, test.n)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLimitStrategy(t *testing.T) {
+	strategy := &InterpolationSearch{Min: 40, Max: 95, Tolerance: 0.001}
+	tests := []struct {
+		max  int
+		want SearchStrategy
+	}{
+		{80, &InterpolationSearch{Min: 40, Max: 80, Tolerance: 0.001}},
+		{95, &InterpolationSearch{Min: 40, Max: 95, Tolerance: 0.001}},
+		{100, &InterpolationSearch{Min: 40, Max: 95, Tolerance: 0.001}},
+		{30, &InterpolationSearch{Min: 30, Max: 30, Tolerance: 0.001}},
+	}
+	for _, test := range tests {
+		if got := limitStrategy(strategy, test.max); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("max %d: got %+v, want %+v", test.max, got, test.want)
+		}
+	}
+	if strategy.Max != 95 {
+		t.Errorf("limiting changed the strategy to %+v", strategy)
+	}
+	if got := limitStrategy(&BinarySearch{Min: 0, Max: 100}, 60); !reflect.DeepEqual(got, &BinarySearch{Min: 0, Max: 60}) {
+		t.Errorf("got %+v, want a binary search up to 60", got)
+	}
+	unbounded := fixedStrategy{90, 80}
+	if got := limitStrategy(unbounded, 60); !reflect.DeepEqual(got, unbounded) {
+		t.Errorf("got %+v, want the unbounded strategy unchanged", got)
+	}
+}
+
+func TestMonotonic(t *testing.T) {
+	tests := []struct {
+		name   string
+		probes []Probe
+		want   bool
+	}{
+		{"empty", nil, true},
+		{"increasing", []Probe{{Quality: 50, Score: 0.9, Size: 1000}, {Quality: 70, Score: 0.95, Size: 1500}}, true},
+		{"unordered", []Probe{{Quality: 70, Score: 0.95, Size: 1500}, {Quality: 50, Score: 0.9, Size: 1000}}, true},
+		{"repeated quality", []Probe{{Quality: 50, Score: 0.9, Size: 1000}, {Quality: 50, Score: 0.9, Size: 1000}, {Quality: 70, Score: 0.95, Size: 1500}}, true},
+		{"score drops", []Probe{{Quality: 50, Score: 0.95, Size: 1000}, {Quality: 70, Score: 0.93, Size: 1500}}, false},
+		{"size drops", []Probe{{Quality: 50, Score: 0.9, Size: 1500}, {Quality: 70, Score: 0.95, Size: 1000}}, false},
+	}
+	for _, test := range tests {
+		if got := monotonic(test.probes); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseSearchStrategy(t *testing.T) {
+	tests := []struct {
+		spec string
+		want SearchStrategy
+	}{
+		{"interpolation", &InterpolationSearch{Min: 40, Max: 95, Tolerance: 0.0005}},
+		{"binary:min=0,max=100", &BinarySearch{Min: 0, Max: 100, Tolerance: 0.0005}},
+		{" interpolation:tolerance=0.001, max=90 ", &InterpolationSearch{Min: 40, Max: 90, Tolerance: 0.001}},
+	}
+	for _, test := range tests {
+		got, err := ParseSearchStrategy(test.spec)
+		if err != nil {
+			t.Errorf("%q: %v", test.spec, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %+v, want %+v", test.spec, got, test.want)
+		}
+	}
+
+	for _, spec := range []string{"linear", "binary:min=96,max=95", "binary:max=101", "binary:step=2", "binary:min", "binary:min=x"} {
+		if _, err := ParseSearchStrategy(spec); err == nil {
+			t.Errorf("%q: no error", spec)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package optimizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var _ ImageOptimizer = &SvgOptimizer{}
+
+type SvgOptimizer struct {
+	// Number of decimal places numeric values are rounded to.
+	Precision int
+}
+
+func (o *SvgOptimizer) CanOptimize(mimeType string, acceptedTypes []string) bool {
+	return mimeType == "image/svg+xml" && isFiletypeAccepted(acceptedTypes, []string{"image/svg+xml", "image/*", "*/*"})
+}
+
+func (o *SvgOptimizer) Optimize(ctx context.Context, source *ImageDescription, dpr float64) (*ImageDescription, error) {
+	input, err := source.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	var output bytes.Buffer
+	err = minifySvg(&output, input, o.Precision)
+	if err != nil {
+		return nil, errors.New("minifying svg: " + err.Error())
+	}
+
+	return describeData(Name("svg-minify"), output.Bytes(), "image/svg+xml"), nil
+}
+
+// Namespace prefixes used by editors to store their own state.
+var svgEditorPrefixes = []string{"inkscape", "sodipodi", "sketch", "serif"}
+
+// Elements that do not affect rendering.
+var svgMetadataElements = []string{"metadata"}
+
+// Elements in which whitespace is significant.
+var svgTextElements = []string{"text", "tspan", "textPath"}
+
+// Elements whose character data is kept verbatim.
+var svgVerbatimElements = []string{"script", "style"}
+
+// Attributes holding lists of numbers, path data is handled separately.
+// Transforms are not rounded, small scale factors would become zero.
+var svgNumericAttributes = []string{
+	"points", "viewBox",
+	"x", "y", "x1", "y1", "x2", "y2", "cx", "cy", "r", "rx", "ry", "fx", "fy",
+	"width", "height", "dx", "dy", "offset", "stroke-width", "stroke-dashoffset",
+	"stroke-dasharray", "stroke-miterlimit", "opacity", "fill-opacity", "stroke-opacity",
+	"stop-opacity", "font-size", "letter-spacing",
+}
+
+// Attributes whose value equals the default and which are not inherited by
+// children, so removing them never changes rendering.
+var svgDefaultAttributes = map[string]string{
+	"opacity":             "1",
+	"version":             "1.1",
+	"baseProfile":         "full",
+	"preserveAspectRatio": "xMidYMid meet",
+}
+
+var svgRemovedAttributes = []string{"enable-background", "data-name"}
+
+var svgNumberRegexp = regexp.MustCompile(`-?(?:\d+\.?\d*|\.\d+)(?:[eE][-+]?\d+)?`)
+
+func minifySvg(w io.Writer, r io.Reader, precision int) error {
+	tokens, err := readSvgTokens(r)
+	if err != nil {
+		return err
+	}
+
+	usedPrefixes := make(map[string]bool)
+	for _, token := range tokens {
+		if start, ok := token.(xml.StartElement); ok {
+			usedPrefixes[start.Name.Space] = true
+			for _, attr := range start.Attr {
+				if attr.Name.Space != "xmlns" {
+					usedPrefixes[attr.Name.Space] = true
+				}
+			}
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	preserveDepth, verbatimDepth := 0, 0
+	for i, token := range tokens {
+		switch t := token.(type) {
+		case xml.StartElement:
+			buf.WriteByte('<')
+			writeSvgName(buf, t.Name)
+			for _, attr := range t.Attr {
+				if attr.Name.Space == "xmlns" && !usedPrefixes[attr.Name.Local] {
+					continue
+				}
+				value := attr.Value
+				if attr.Name.Space == "" && attr.Name.Local == "d" {
+					value = roundSvgPath(value, precision)
+				} else if attr.Name.Space == "" && contains(svgNumericAttributes, attr.Name.Local) {
+					value = roundSvgNumbers(value, precision)
+				}
+				if attr.Name.Space == "" && attr.Name.Local == "style" {
+					value = strings.TrimSpace(value)
+				}
+				buf.WriteByte(' ')
+				writeSvgName(buf, attr.Name)
+				buf.WriteString(`="`)
+				buf.WriteString(escapeSvgAttribute(value))
+				buf.WriteByte('"')
+			}
+			if preserveDepth > 0 || isSvgPreserveElement(t) {
+				preserveDepth++
+			}
+			if verbatimDepth > 0 || isSvgVerbatimElement(t.Name) {
+				verbatimDepth++
+			}
+			if i+1 < len(tokens) {
+				if _, ok := tokens[i+1].(xml.EndElement); ok {
+					buf.WriteString("/>")
+					continue
+				}
+			}
+			buf.WriteByte('>')
+		case xml.EndElement:
+			if preserveDepth > 0 {
+				preserveDepth--
+			}
+			if verbatimDepth > 0 {
+				verbatimDepth--
+			}
+			if i > 0 {
+				if _, ok := tokens[i-1].(xml.StartElement); ok {
+					continue
+				}
+			}
+			buf.WriteString("</")
+			writeSvgName(buf, t.Name)
+			buf.WriteByte('>')
+		case xml.CharData:
+			if verbatimDepth > 0 {
+				writeSvgVerbatim(buf, string(t))
+				continue
+			}
+			text := string(t)
+			if preserveDepth == 0 {
+				text = strings.Join(strings.Fields(text), " ")
+			}
+			xml.EscapeText(buf, []byte(text))
+		case xml.ProcInst:
+			buf.WriteString("<?")
+			buf.WriteString(t.Target)
+			buf.WriteByte(' ')
+			buf.Write(t.Inst)
+			buf.WriteString("?>")
+		}
+	}
+
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// readSvgTokens returns the tokens of the document with comments, metadata,
+// editor specific content and redundant whitespace removed.
+func readSvgTokens(r io.Reader) ([]xml.Token, error) {
+	decoder := xml.NewDecoder(r)
+	tokens := make([]xml.Token, 0, 64)
+	var skipDepth, textDepth int
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			if skipDepth > 0 || isSvgRemovedElement(t.Name) {
+				skipDepth++
+				continue
+			}
+			if textDepth > 0 || isSvgPreserveElement(t) {
+				textDepth++
+			}
+			attrs := make([]xml.Attr, 0, len(t.Attr))
+			for _, attr := range t.Attr {
+				if !isSvgRemovedAttribute(attr) {
+					attrs = append(attrs, attr)
+				}
+			}
+			t.Attr = attrs
+			tokens = append(tokens, t.Copy())
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			if textDepth > 0 {
+				textDepth--
+			}
+			tokens = append(tokens, t)
+		case xml.CharData:
+			if skipDepth > 0 {
+				continue
+			}
+			if textDepth == 0 && len(bytes.TrimSpace(t)) == 0 {
+				continue
+			}
+			tokens = append(tokens, t.Copy())
+		case xml.ProcInst:
+			if skipDepth > 0 || t.Target == "xml" {
+				continue
+			}
+			tokens = append(tokens, t.Copy())
+		case xml.Directive:
+			if bytes.Contains(t, []byte("[")) {
+				return nil, errors.New("documents with an internal DTD subset are not supported")
+			}
+		}
+	}
+	return tokens, nil
+}
+
+func isSvgPreserveElement(start xml.StartElement) bool {
+	if contains(svgTextElements, start.Name.Local) || isSvgVerbatimElement(start.Name) {
+		return true
+	}
+	for _, attr := range start.Attr {
+		if attr.Name.Space == "xml" && attr.Name.Local == "space" && attr.Value == "preserve" {
+			return true
+		}
+	}
+	return false
+}
+
+func isSvgVerbatimElement(name xml.Name) bool {
+	return name.Space == "" && contains(svgVerbatimElements, name.Local)
+}
+
+func isSvgRemovedElement(name xml.Name) bool {
+	return contains(svgEditorPrefixes, name.Space) || (name.Space == "" && contains(svgMetadataElements, name.Local))
+}
+
+func isSvgRemovedAttribute(attr xml.Attr) bool {
+	if contains(svgEditorPrefixes, attr.Name.Space) {
+		return true
+	}
+	if attr.Name.Space == "xmlns" && contains(svgEditorPrefixes, attr.Name.Local) {
+		return true
+	}
+	if attr.Name.Space != "" {
+		return false
+	}
+	if contains(svgRemovedAttributes, attr.Name.Local) {
+		return true
+	}
+	if strings.TrimSpace(attr.Value) == "" && attr.Name.Local != "xmlns" {
+		return true
+	}
+	defaultValue, ok := svgDefaultAttributes[attr.Name.Local]
+	return ok && strings.TrimSpace(attr.Value) == defaultValue
+}
+
+func writeSvgName(buf *bytes.Buffer, name xml.Name) {
+	if name.Space != "" {
+		buf.WriteString(name.Space)
+		buf.WriteByte(':')
+	}
+	buf.WriteString(name.Local)
+}
+
+// writeSvgVerbatim writes the text unchanged, in a CDATA section when it
+// contains markup characters.
+func writeSvgVerbatim(buf *bytes.Buffer, text string) {
+	if !strings.ContainsAny(text, "<&") && !strings.Contains(text, "]]>") {
+		buf.WriteString(text)
+		return
+	}
+	buf.WriteString("<![CDATA[")
+	buf.WriteString(strings.Replace(text, "]]>", "]]]]><![CDATA[>", -1))
+	buf.WriteString("]]>")
+}
+
+func escapeSvgAttribute(value string) string {
+	var buf bytes.Buffer
+	for _, r := range value {
+		switch r {
+		case '&':
+			buf.WriteString("&amp;")
+		case '<':
+			buf.WriteString("&lt;")
+		case '"':
+			buf.WriteString("&quot;")
+		case '\n':
+			buf.WriteString("&#xA;")
+		case '\t':
+			buf.WriteString("&#x9;")
+		case '\r':
+			buf.WriteString("&#xD;")
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+// roundSvgNumbers rounds the numbers in the value. A space is inserted where
+// a rounded number would merge with the number following it, as in "1.0.5".
+func roundSvgNumbers(value string, precision int) string {
+	var buf bytes.Buffer
+	prev := ""
+	end := 0
+	for _, loc := range svgNumberRegexp.FindAllStringIndex(value, -1) {
+		number := roundSvgNumber(value[loc[0]:loc[1]], precision)
+		if loc[0] == end && prev != "" && !svgNumbersSeparated(prev, number) {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(value[end:loc[0]])
+		buf.WriteString(number)
+		prev = number
+		end = loc[1]
+	}
+	buf.WriteString(value[end:])
+	return buf.String()
+}
+
+// Commands of the path data.
+const svgPathCommands = "MmZzLlHhVvCcSsQqTtAa"
+
+// roundSvgPath rounds the numbers of the path data and removes the
+// separators that are not needed. The flags of arc commands are single digits
+// that may be written without separators, as in "a5 5 0 0110 10". Path data
+// that cannot be parsed is returned unchanged.
+func roundSvgPath(d string, precision int) string {
+	var buf bytes.Buffer
+	var command byte
+	param := 0
+	prev := ""
+	prevFlag := false
+	for i := 0; i < len(d); {
+		c := d[i]
+		if c == ' ' || c == ',' || c == '\t' || c == '\n' || c == '\r' {
+			i++
+			continue
+		}
+		if strings.IndexByte(svgPathCommands, c) >= 0 {
+			buf.WriteByte(c)
+			command = c
+			param = 0
+			prev = ""
+			prevFlag = false
+			i++
+			continue
+		}
+
+		flag := (command == 'a' || command == 'A') && (param%7 == 3 || param%7 == 4)
+		var number string
+		if flag {
+			if c != '0' && c != '1' {
+				return d
+			}
+			number = d[i : i+1]
+			i++
+		} else {
+			loc := svgNumberRegexp.FindStringIndex(d[i:])
+			if loc == nil || loc[0] != 0 {
+				return d
+			}
+			number = roundSvgNumber(d[i:i+loc[1]], precision)
+			i += loc[1]
+		}
+		if prev != "" && !prevFlag && !svgNumbersSeparated(prev, number) {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(number)
+		prev = number
+		prevFlag = flag
+		param++
+	}
+	return buf.String()
+}
+
+// svgNumbersSeparated reports whether the numbers can be written next to
+// each other without being read as one number.
+func svgNumbersSeparated(prev, number string) bool {
+	if strings.HasPrefix(number, "-") {
+		return true
+	}
+	return strings.HasPrefix(number, ".") && strings.ContainsAny(prev, ".eE")
+}
+
+func roundSvgNumber(number string, precision int) string {
+	f, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return number
+	}
+	scale := math.Pow(10, float64(precision))
+	f = math.Floor(f*scale+0.5) / scale
+	if f == 0 {
+		return "0"
+	}
+	formatted := strconv.FormatFloat(f, 'f', -1, 64)
+	if strings.HasPrefix(formatted, "0.") {
+		formatted = formatted[1:]
+	} else if strings.HasPrefix(formatted, "-0.") {
+		formatted = "-" + formatted[2:]
+	}
+	return formatted
+}
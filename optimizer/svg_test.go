@@ -0,0 +1,96 @@
+package optimizer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRoundSvgPath(t *testing.T) {
+	tests := []struct {
+		d    string
+		want string
+	}{
+		{"M0 0a5 5 0 0110 10", "M0 0a5 5 0 0110 10"},
+		{"M 0,0 A 5,5 0 0,1 10,10", "M0 0A5 5 0 0110 10"},
+		{"a5 5 0 1 0 -3.14159 2", "a5 5 0 10-3.142 2"},
+		{"M10 10a1 1 0 01.5.5a1 1 0 11-1 0", "M10 10a1 1 0 01.5.5a1 1 0 11-1 0"},
+		{"M1.0004.5 2.25L3.33333-4", "M1 .5 2.25L3.333-4"},
+		{"m0.50 0.25l-0.1 0z", "m.5.25l-.1 0z"},
+		{"M1+2", "M1+2"},
+	}
+	for _, test := range tests {
+		if got := roundSvgPath(test.d, 3); got != test.want {
+			t.Errorf("roundSvgPath(%q) = %q, want %q", test.d, got, test.want)
+		}
+	}
+}
+
+func TestRoundSvgNumbers(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"0 0 100.00001 50", "0 0 100 50"},
+		{"1.0001.5 2", "1 .5 2"},
+		{"0.12345,-0.5 1,2", ".123,-.5 1,2"},
+	}
+	for _, test := range tests {
+		if got := roundSvgNumbers(test.value, 3); got != test.want {
+			t.Errorf("roundSvgNumbers(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestMinifySvgKeepsArcFlags(t *testing.T) {
+	input := `<svg xmlns="http://www.w3.org/2000/svg"><path d="M0 0a5 5 0 0110 10"/></svg>`
+	var output bytes.Buffer
+	if err := minifySvg(&output, strings.NewReader(input), 3); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), `d="M0 0a5 5 0 0110 10"`) {
+		t.Errorf("arc flags changed: %s", output.String())
+	}
+}
+
+func TestMinifySvgKeepsSmallTransforms(t *testing.T) {
+	input := `<svg xmlns="http://www.w3.org/2000/svg"><g transform="matrix(0.0004883 0 0 -0.0004883 0 1)"><rect width="2048" height="2048" transform="scale(0.0004)"/></g></svg>`
+	var output bytes.Buffer
+	if err := minifySvg(&output, strings.NewReader(input), 3); err != nil {
+		t.Fatal(err)
+	}
+	for _, transform := range []string{`transform="matrix(0.0004883 0 0 -0.0004883 0 1)"`, `transform="scale(0.0004)"`} {
+		if !strings.Contains(output.String(), transform) {
+			t.Errorf("%s changed: %s", transform, output.String())
+		}
+	}
+}
+
+func TestMinifySvgKeepsScriptsAndStyles(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{
+			`<svg><script>// hello` + "\n" + `var a = 1;` + "\n" + `alert(a)</script></svg>`,
+			`<svg><script>// hello` + "\n" + `var a = 1;` + "\n" + `alert(a)</script></svg>`,
+		},
+		{
+			`<svg><script><![CDATA[if (a < b && c) {}]]></script></svg>`,
+			`<svg><script><![CDATA[if (a < b && c) {}]]></script></svg>`,
+		},
+		{
+			`<svg><style>.a::after { content: "  x  " }</style></svg>`,
+			`<svg><style>.a::after { content: "  x  " }</style></svg>`,
+		},
+	}
+	for _, test := range tests {
+		var output bytes.Buffer
+		if err := minifySvg(&output, strings.NewReader(test.input), 3); err != nil {
+			t.Fatal(err)
+		}
+		if output.String() != test.want {
+			t.Errorf("minifySvg(%q) = %q, want %q", test.input, output.String(), test.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package optimizer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+)
+
+// Transcoder converts source images that browsers cannot display into a
+// lossless PNG which is then handled by the png optimizers.
+type Transcoder interface {
+	CanTranscode(mimeType string) bool
+	Transcode(ctx context.Context, source *ImageDescription) (*ImageDescription, error)
+}
+
+// ToolTranscoder is implemented by transcoders running external tools, they
+// are disabled by CheckTranscoders when the tools are missing.
+type ToolTranscoder interface {
+	Transcoder
+	Tools() []string
+}
+
+var DefaultTranscoders = []Transcoder{
+	&DecodingTranscoder{
+		MimeTypes: []string{"image/tiff", "image/bmp"},
+	},
+	&HeifTranscoder{
+		Args: []string{},
+	},
+}
+
+var _ Transcoder = &DecodingTranscoder{}
+
+// DecodingTranscoder uses the decoders registered with the image package.
+type DecodingTranscoder struct {
+	MimeTypes []string
+}
+
+func (t *DecodingTranscoder) CanTranscode(mimeType string) bool {
+	return contains(t.MimeTypes, mimeType)
+}
+
+func (t *DecodingTranscoder) Transcode(ctx context.Context, source *ImageDescription) (*ImageDescription, error) {
+	input, err := source.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	img, format, err := image.Decode(bufio.NewReader(input))
+	if err != nil {
+		return nil, &DecodeError{Err: err}
+	}
+
+	encoder := &png.Encoder{
+		CompressionLevel: png.BestSpeed,
+	}
+	var output bytes.Buffer
+	err = encoder.Encode(&output, img)
+	if err != nil {
+		return nil, err
+	}
+
+	return describeData(Name("transcode["+format+"]"), output.Bytes(), "image/png"), nil
+}
+
+var _ ToolTranscoder = &HeifTranscoder{}
+
+// HeifTranscoder converts HEIF/HEIC images with heif-convert from libheif.
+type HeifTranscoder struct {
+	Args     []string
+	Executor Executor
+}
+
+func (t *HeifTranscoder) CanTranscode(mimeType string) bool {
+	return mimeType == "image/heic" || mimeType == "image/heif"
+}
+
+func (t *HeifTranscoder) Tools() []string {
+	return []string{"heif-convert"}
+}
+
+func (t *HeifTranscoder) Transcode(ctx context.Context, source *ImageDescription) (*ImageDescription, error) {
+	sourcePath, cleanup, err := source.File(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	workspace := workspaceFrom(ctx)
+	outputPath := workspace.TempFilename(".png")
+	args := append([]string{}, t.Args...)
+	err = run(ctx, t.Executor, "heif-convert", append(args, sourcePath, outputPath)...)
+	if err != nil {
+		workspace.Remove(outputPath)
+		return nil, &ToolError{Tool: "heif-convert", Err: err}
+	}
+
+	size, err := workspace.Track(outputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ImageDescription{
+		Optimizer: Name("transcode[heif]"),
+		Path:      outputPath,
+		MimeType:  "image/png",
+		Size:      size,
+	}, nil
+}
+
+func findTranscoder(transcoders []Transcoder, mimeType string) Transcoder {
+	for _, transcoder := range transcoders {
+		if transcoder.CanTranscode(mimeType) {
+			return transcoder
+		}
+	}
+	return nil
+}
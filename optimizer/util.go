@@ -9,14 +9,14 @@ import (
 	"time"
 )
 
-func tempFilename(dir, originalFilename string) string {
+func tempFilename(dir, ext string) string {
 	randomBytes := make([]byte, 10)
 	_, err := rand.Read(randomBytes)
 	if err != nil {
 		panic("could not generate new temporary filename")
 	}
 	timestamp := strconv.FormatInt(time.Now().UnixNano(), 10)
-	fileName := timestamp + "-" + hex.EncodeToString(randomBytes) + "-" + originalFilename
+	fileName := timestamp + "-" + hex.EncodeToString(randomBytes) + ext
 	return path.Join(dir, fileName)
 }
 
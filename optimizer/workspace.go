@@ -0,0 +1,191 @@
+package optimizer
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Directory in which workspaces are created, os.TempDir() when empty.
+var DefaultWorkspaceDir = ""
+
+// Maximum number of bytes stored in a workspace, unlimited when zero.
+var DefaultWorkspaceQuota int64 = 0
+
+var ErrQuotaExceeded = errors.New("workspace disk quota exceeded")
+
+// Workspace owns the intermediate files created while optimizing an image.
+// All files are kept in a private directory which is removed on Close.
+// A nil workspace creates untracked files in os.TempDir().
+type Workspace struct {
+	dir   string
+	quota int64
+
+	mu    sync.Mutex
+	used  int64
+	files map[string]int64
+}
+
+func NewWorkspace(parentDir string, quota int64) (*Workspace, error) {
+	if parentDir == "" {
+		parentDir = os.TempDir()
+	}
+	dir, err := ioutil.TempDir(parentDir, "imageoptimizer-")
+	if err != nil {
+		return nil, err
+	}
+	return &Workspace{
+		dir:   dir,
+		quota: quota,
+		files: make(map[string]int64),
+	}, nil
+}
+
+// TempFilename returns a new unique filename in the workspace.
+func (w *Workspace) TempFilename(ext string) string {
+	if w == nil {
+		return tempFilename(os.TempDir(), ext)
+	}
+	return tempFilename(w.dir, ext)
+}
+
+// Track accounts for the file written by an external tool. Files exceeding
+// the quota are removed.
+func (w *Workspace) Track(filePath string) (int64, error) {
+	fileStat, err := os.Stat(filePath)
+	if err != nil {
+		return 0, err
+	}
+	if w == nil {
+		return fileStat.Size(), nil
+	}
+
+	err = w.reserve(filePath, fileStat.Size())
+	if err != nil {
+		os.Remove(filePath)
+		return 0, err
+	}
+	return fileStat.Size(), nil
+}
+
+// WriteFile writes the data to a new file in the workspace.
+func (w *Workspace) WriteFile(ext string, data []byte) (string, error) {
+	filePath := w.TempFilename(ext)
+	if w != nil {
+		err := w.reserve(filePath, int64(len(data)))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err := ioutil.WriteFile(filePath, data, 0644)
+	if err != nil {
+		w.Remove(filePath)
+		return "", err
+	}
+	return filePath, nil
+}
+
+func (w *Workspace) reserve(filePath string, size int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.files == nil {
+		return errors.New("workspace closed")
+	}
+	if w.quota > 0 && w.used+size > w.quota {
+		return ErrQuotaExceeded
+	}
+	w.used += size
+	w.files[filePath] = size
+	return nil
+}
+
+// Owns reports whether the file is stored in the workspace.
+func (w *Workspace) Owns(filePath string) bool {
+	if w == nil || filePath == "" {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.files[filePath]
+	return ok
+}
+
+// Remove deletes the file and releases its quota.
+func (w *Workspace) Remove(filePath string) {
+	os.Remove(filePath)
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if size, ok := w.files[filePath]; ok {
+		w.used -= size
+		delete(w.files, filePath)
+	}
+}
+
+// Discard deletes the file backing the image if it is owned by the workspace.
+func (w *Workspace) Discard(imageDesc *ImageDescription) {
+	if imageDesc != nil && w.Owns(imageDesc.Path) {
+		w.Remove(imageDesc.Path)
+	}
+}
+
+// Close removes the workspace with all of its files.
+func (w *Workspace) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	w.files = nil
+	w.used = 0
+	w.mu.Unlock()
+	return os.RemoveAll(w.dir)
+}
+
+// load moves the image into memory if it is stored in the workspace so it
+// stays available after the workspace is closed.
+func (w *Workspace) load(imageDesc *ImageDescription) (*ImageDescription, error) {
+	if imageDesc == nil || imageDesc.Data != nil || !w.Owns(imageDesc.Path) {
+		return imageDesc, nil
+	}
+	data, err := ioutil.ReadFile(imageDesc.Path)
+	if err != nil {
+		return nil, err
+	}
+	loaded := *imageDesc
+	loaded.Path = ""
+	loaded.Data = data
+	return &loaded, nil
+}
+
+type workspaceKey struct{}
+
+// WithWorkspace returns a context in which the optimizers create their
+// intermediate files in the workspace.
+func WithWorkspace(ctx context.Context, workspace *Workspace) context.Context {
+	return context.WithValue(ctx, workspaceKey{}, workspace)
+}
+
+func workspaceFrom(ctx context.Context) *Workspace {
+	workspace, _ := ctx.Value(workspaceKey{}).(*Workspace)
+	return workspace
+}
+
+// extension returns the filename extension used for files of the mime type.
+func extension(mimeType string) string {
+	parts := strings.SplitN(mimeType, "/", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	ext := parts[1]
+	if i := strings.IndexAny(ext, "+;"); i >= 0 {
+		ext = ext[:i]
+	}
+	return "." + filepath.Base(ext)
+}